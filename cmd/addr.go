@@ -0,0 +1,65 @@
+package cmd
+
+// 2021-09-18 服务地址支持unix://path，同一主机的服务通过unix socket连接
+// 多个地址以逗号分隔，如unix:///tmp/hall.sock,:9010
+// unix socket不使用TLS，也不校验客户端证书（VerifyClient），访问控制依赖socket文件的权限
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+const unixScheme = "unix://"
+
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, unixScheme)
+}
+
+// 拆分逗号分隔的地址
+func splitAddrs(addr string) []string {
+	var addrs []string
+	for _, s := range strings.Split(addr, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			addrs = append(addrs, s)
+		}
+	}
+	return addrs
+}
+
+// 多个地址时依次尝试，如其他主机无法连接unix socket时使用TCP
+func dial(addr string) (net.Conn, error) {
+	addrs := splitAddrs(addr)
+	if len(addrs) == 0 {
+		addrs = []string{addr}
+	}
+
+	var err error
+	for _, addr := range addrs {
+		var c net.Conn
+		if c, err = dialOne(addr); err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
+// 监听单个地址。unix socket存在残留文件且无法连接时先删除
+func listen(addr string) (net.Listener, error) {
+	switch {
+	case isMemAddr(addr):
+		return ListenMem(addr)
+	case isUnixAddr(addr):
+		path := strings.TrimPrefix(addr, unixScheme)
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			// 其他进程仍在监听时不删除，由net.Listen返回地址已使用
+			if c, err := net.Dial("unix", path); err == nil {
+				c.Close()
+			} else {
+				os.Remove(path)
+			}
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
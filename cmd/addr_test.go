@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixAddr(t *testing.T) {
+	dir, err := os.MkdirTemp("", "quasar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := "unix://" + filepath.Join(dir, "test.sock")
+
+	server, client := NewNode(), NewNode()
+	srv := &Server{Addr: addr, Node: server}
+	go srv.ListenAndServe()
+	defer srv.Shutdown(context.Background())
+	NodeOnWithoutQueue(server, "TestUnixEcho", func(ctx *Context, args *testCodecArgs) {
+		ctx.WriteJSON("TestUnixEcho", args)
+	})
+
+	// 第一个地址无法连接时使用下一个地址
+	client.SetRouterAddr("unix://" + filepath.Join(dir, "none.sock") + "," + addr)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(filepath.Join(dir, "test.sock")); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	out := &testCodecArgs{}
+	if err := client.Call(ctx, "router", "TestUnixEcho", &testCodecArgs{N: 5}, out); err != nil || out.N != 5 {
+		t.Error("call unix addr", out, err)
+	}
+}
+
+func TestSplitAddrs(t *testing.T) {
+	addrs := splitAddrs(" unix:///tmp/a.sock, :9010,")
+	if len(addrs) != 2 || addrs[0] != "unix:///tmp/a.sock" || addrs[1] != ":9010" {
+		t.Error("split addrs", addrs)
+	}
+}
+
+func TestListenUnixInUse(t *testing.T) {
+	dir, err := os.MkdirTemp("", "quasar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := "unix://" + filepath.Join(dir, "test.sock")
+
+	l, err := listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 正在监听的socket不删除
+	if _, err := listen(addr); err == nil {
+		t.Error("listen socket in use")
+	}
+	if c, err := dial(addr); err != nil {
+		t.Error("socket removed", err)
+	} else {
+		c.Close()
+	}
+
+	// 进程退出后残留的文件
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = listen(addr)
+	if err != nil {
+		t.Fatal("listen stale socket", err)
+	}
+	l.Close()
+}
@@ -0,0 +1,245 @@
+package cmd
+
+// 2021-08-02 发送队列已满时的处理策略，服务内部连接与网关连接共用
+// 统计按连接记录，同时累计到连接类型，重新设置策略时不清空
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type BackpressurePolicy int
+
+const (
+	BlockWithTimeout BackpressurePolicy = iota // 等待，超时后丢弃当前消息。超时时间为0时一直等待
+	DropOldest                                 // 丢弃最早的消息
+	DropNewest                                 // 丢弃当前消息
+	Disconnect                                 // 断开连接
+)
+
+var (
+	ErrSendTimeout    = errors.New("write timeout")
+	ErrSendQueueFull  = errors.New("write too busy")
+	ErrSendDisconnect = errors.New("write too busy, disconnect")
+
+	errSendQueueClosed = errors.New("connection is closed")
+)
+
+var backpressurePolicies = map[string]BackpressurePolicy{
+	"block":       BlockWithTimeout,
+	"drop_oldest": DropOldest,
+	"drop_newest": DropNewest,
+	"disconnect":  Disconnect,
+}
+
+// 统计
+type BackpressureStats struct {
+	Sent       int64 // 入队成功
+	Blocked    int64 // 等待后入队成功
+	Timeout    int64
+	DropOldest int64
+	DropNewest int64
+	Disconnect int64
+}
+
+func (s *BackpressureStats) load() BackpressureStats {
+	return BackpressureStats{
+		Sent:       atomic.LoadInt64(&s.Sent),
+		Blocked:    atomic.LoadInt64(&s.Blocked),
+		Timeout:    atomic.LoadInt64(&s.Timeout),
+		DropOldest: atomic.LoadInt64(&s.DropOldest),
+		DropNewest: atomic.LoadInt64(&s.DropNewest),
+		Disconnect: atomic.LoadInt64(&s.Disconnect),
+	}
+}
+
+var (
+	statSent       = func(s *BackpressureStats) *int64 { return &s.Sent }
+	statBlocked    = func(s *BackpressureStats) *int64 { return &s.Blocked }
+	statTimeout    = func(s *BackpressureStats) *int64 { return &s.Timeout }
+	statDropOldest = func(s *BackpressureStats) *int64 { return &s.DropOldest }
+	statDropNewest = func(s *BackpressureStats) *int64 { return &s.DropNewest }
+	statDisconnect = func(s *BackpressureStats) *int64 { return &s.Disconnect }
+)
+
+// 同一类型的连接使用相同的策略，启动时设置
+type Backpressure struct {
+	Policy  BackpressurePolicy
+	Timeout time.Duration
+
+	total *BackpressureStats // 同类型连接的累计统计
+}
+
+// 同类型连接的累计统计
+func (bp *Backpressure) Stats() BackpressureStats {
+	if bp.total == nil {
+		return BackpressureStats{}
+	}
+	return bp.total.load()
+}
+
+var (
+	// 默认不等待，避免阻塞调用方
+	backpressures = map[string]*Backpressure{
+		"tcp": {Policy: DropNewest, total: &BackpressureStats{}},
+		"ws":  {Policy: DropNewest, total: &BackpressureStats{}},
+	}
+	backpressureMu sync.RWMutex
+)
+
+// 连接类型：tcp、ws
+func GetBackpressure(connType string) *Backpressure {
+	backpressureMu.RLock()
+	defer backpressureMu.RUnlock()
+	return backpressures[connType]
+}
+
+// 仅对之后创建的连接生效
+func SetBackpressure(connType string, policy BackpressurePolicy, timeout time.Duration) {
+	backpressureMu.Lock()
+	defer backpressureMu.Unlock()
+	total := &BackpressureStats{}
+	if old, ok := backpressures[connType]; ok {
+		total = old.total
+	}
+	backpressures[connType] = &Backpressure{Policy: policy, Timeout: timeout, total: total}
+}
+
+// Prometheus文本格式输出各类型连接的统计
+func writeBackpressureMetrics(w io.Writer) {
+	backpressureMu.RLock()
+	types := make([]string, 0, len(backpressures))
+	stats := map[string]BackpressureStats{}
+	for connType, bp := range backpressures {
+		types = append(types, connType)
+		stats[connType] = bp.Stats()
+	}
+	backpressureMu.RUnlock()
+	sort.Strings(types)
+
+	fmt.Fprintln(w, "# HELP quasar_send_queue_total Number of messages pushed to send queues by result.")
+	fmt.Fprintln(w, "# TYPE quasar_send_queue_total counter")
+	for _, connType := range types {
+		s := stats[connType]
+		for _, r := range []struct {
+			name string
+			n    int64
+		}{
+			{"sent", s.Sent},
+			{"blocked", s.Blocked},
+			{"timeout", s.Timeout},
+			{"drop_oldest", s.DropOldest},
+			{"drop_newest", s.DropNewest},
+			{"disconnect", s.Disconnect},
+		} {
+			fmt.Fprintf(w, "quasar_send_queue_total{conn=%q,result=%q} %d\n", connType, r.name, r.n)
+		}
+	}
+}
+
+// 发送队列
+type SendQueue struct {
+	stats   BackpressureStats // 当前连接的统计，原子操作，保持64位对齐
+	ch      chan []byte
+	bp      *Backpressure
+	isClose bool
+	mu      sync.RWMutex
+
+	done      chan struct{} // 关闭时通知等待中的Push
+	closeOnce sync.Once
+}
+
+func NewSendQueue(size int, bp *Backpressure) *SendQueue {
+	return &SendQueue{ch: make(chan []byte, size), bp: bp, done: make(chan struct{})}
+}
+
+// 当前连接的统计
+func (q *SendQueue) Stats() BackpressureStats {
+	return q.stats.load()
+}
+
+// 累计到当前连接及同类型连接
+func (q *SendQueue) count(stat func(*BackpressureStats) *int64) {
+	atomic.AddInt64(stat(&q.stats), 1)
+	if q.bp.total != nil {
+		atomic.AddInt64(stat(q.bp.total), 1)
+	}
+}
+
+func (q *SendQueue) C() <-chan []byte {
+	return q.ch
+}
+
+func (q *SendQueue) Close() {
+	// 先唤醒等待中的Push释放读锁，避免写协程退出后无法关闭
+	q.closeOnce.Do(func() { close(q.done) })
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.isClose {
+		q.isClose = true
+		close(q.ch)
+	}
+}
+
+// 返回ErrSendDisconnect时，调用方需关闭连接
+func (q *SendQueue) Push(data []byte) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.isClose {
+		return errSendQueueClosed
+	}
+
+	bp := q.bp
+	select {
+	case q.ch <- data:
+		q.count(statSent)
+		return nil
+	default:
+	}
+
+	switch bp.Policy {
+	case BlockWithTimeout:
+		var timeout <-chan time.Time
+		if bp.Timeout > 0 {
+			timer := time.NewTimer(bp.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case q.ch <- data:
+			q.count(statSent)
+			q.count(statBlocked)
+			return nil
+		case <-timeout:
+			q.count(statTimeout)
+			return ErrSendTimeout
+		case <-q.done:
+			return errSendQueueClosed
+		}
+	case DropOldest:
+		for {
+			select {
+			case q.ch <- data:
+				q.count(statSent)
+				return nil
+			default:
+			}
+			select {
+			case <-q.ch:
+				q.count(statDropOldest)
+			default:
+			}
+		}
+	case Disconnect:
+		q.count(statDisconnect)
+		return ErrSendDisconnect
+	}
+	q.count(statDropNewest)
+	return ErrSendQueueFull
+}
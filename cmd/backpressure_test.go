@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendQueuePolicy(t *testing.T) {
+	samples := []struct {
+		policy BackpressurePolicy
+		err    error
+		front  string
+	}{
+		{BlockWithTimeout, ErrSendTimeout, "1"},
+		{DropOldest, nil, "2"},
+		{DropNewest, ErrSendQueueFull, "1"},
+		{Disconnect, ErrSendDisconnect, "1"},
+	}
+	for _, sample := range samples {
+		bp := &Backpressure{Policy: sample.policy, Timeout: 10 * time.Millisecond}
+		q := NewSendQueue(1, bp)
+		if err := q.Push([]byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Push([]byte("2")); err != sample.err {
+			t.Errorf("policy %d push full queue: %v", sample.policy, err)
+		}
+		if front := string(<-q.C()); front != sample.front {
+			t.Errorf("policy %d queue front %s", sample.policy, front)
+		}
+
+		stats := q.Stats()
+		if stats.Sent+stats.Timeout+stats.DropNewest+stats.Disconnect != 2 {
+			t.Errorf("policy %d invalid stats %v", sample.policy, stats)
+		}
+	}
+}
+
+func TestSendQueueBlock(t *testing.T) {
+	bp := &Backpressure{Policy: BlockWithTimeout, Timeout: time.Second}
+	q := NewSendQueue(1, bp)
+	q.Push([]byte("1"))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-q.C()
+	}()
+	if err := q.Push([]byte("2")); err != nil {
+		t.Error("push blocked queue", err)
+	}
+	if stats := q.Stats(); stats.Blocked != 1 || stats.Sent != 2 {
+		t.Errorf("invalid stats %v", stats)
+	}
+
+	q.Close()
+	if err := q.Push([]byte("3")); err != errSendQueueClosed {
+		t.Error("push closed queue", err)
+	}
+}
+
+func TestSendQueueCloseBlocked(t *testing.T) {
+	// 一直等待，写协程已退出
+	q := NewSendQueue(1, &Backpressure{Policy: BlockWithTimeout})
+	q.Push([]byte("1"))
+
+	errc := make(chan error, 1)
+	go func() { errc <- q.Push([]byte("2")) }()
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan bool)
+	go func() {
+		q.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close blocked by push")
+	}
+	if err := <-errc; err != errSendQueueClosed {
+		t.Error("push closed queue", err)
+	}
+}
+
+func TestBackpressureStats(t *testing.T) {
+	old := GetBackpressure("test")
+	defer func() {
+		backpressureMu.Lock()
+		if old == nil {
+			delete(backpressures, "test")
+		} else {
+			backpressures["test"] = old
+		}
+		backpressureMu.Unlock()
+	}()
+
+	SetBackpressure("test", DropNewest, 0)
+	q1 := NewSendQueue(1, GetBackpressure("test"))
+	q1.Push([]byte("1"))
+	q1.Push([]byte("2"))
+
+	// 重新设置策略，累计的统计保留
+	SetBackpressure("test", Disconnect, 0)
+	q2 := NewSendQueue(1, GetBackpressure("test"))
+	q2.Push([]byte("1"))
+	q2.Push([]byte("2"))
+
+	if stats := q1.Stats(); stats != (BackpressureStats{Sent: 1, DropNewest: 1}) {
+		t.Errorf("conn stats %v", stats)
+	}
+	if stats := q2.Stats(); stats != (BackpressureStats{Sent: 1, Disconnect: 1}) {
+		t.Errorf("conn stats %v", stats)
+	}
+	if stats := GetBackpressure("test").Stats(); stats != (BackpressureStats{Sent: 2, DropNewest: 1, Disconnect: 1}) {
+		t.Errorf("total stats %v", stats)
+	}
+}
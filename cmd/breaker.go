@@ -0,0 +1,212 @@
+package cmd
+
+// 2021-09-26 目标服务重连期间缓存消息，超时或超出数量后丢弃
+// 连续多次连接失败后熔断，发送消息直接返回错误，连接成功后恢复
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/guogeer/quasar/log"
+)
+
+var (
+	ErrServiceUnavailable = errors.New("service unavailable")
+	ErrPendingFull        = errors.New("pending messages full")
+	ErrPendingExpired     = errors.New("pending message expired")
+)
+
+const (
+	defaultPendingTTL      = 10 * time.Second
+	defaultPendingSize     = 1024
+	defaultBreakerFailures = 5
+)
+
+// 发送失败时回调，如通知玩家服务不可用
+type RouteFailFunc func(serverName string, pkg *Package, err error)
+
+type routeBuffer struct {
+	ttl      time.Duration // 缓存消息的有效期
+	size     int           // 缓存消息的最大数量
+	failures int           // 连续连接失败的次数达到后熔断
+}
+
+type pendingMessage struct {
+	pkg *Package
+	ts  time.Time
+}
+
+// 设置重连期间的缓存及熔断，需在连接前调用。参数为0时使用默认值
+func (node *Node) SetRouteBuffer(ttl time.Duration, size, failures int) {
+	if ttl <= 0 {
+		ttl = defaultPendingTTL
+	}
+	if size <= 0 {
+		size = defaultPendingSize
+	}
+	if failures <= 0 {
+		failures = defaultBreakerFailures
+	}
+
+	cm := node.clients
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.buffer = routeBuffer{ttl: ttl, size: size, failures: failures}
+}
+
+// 设置发送失败的回调
+func (node *Node) OnRouteFail(f RouteFailFunc) {
+	cm := node.clients
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.onRouteFail = f
+}
+
+func (cm *clientManage) routeFail(serverName string, pkg *Package, err error) {
+	cm.mu.RLock()
+	f := cm.onRouteFail
+	cm.mu.RUnlock()
+
+	log.Warnf("route %s.%s %v", serverName, pkg.Id, err)
+	if f != nil {
+		f(serverName, pkg, err)
+	}
+}
+
+// 未连接时缓存消息，熔断时直接返回错误
+func (c *Client) route(pkg *Package) error {
+	var expired []*Package
+	defer func() {
+		for _, pkg := range expired {
+			c.cm.routeFail(c.name, pkg, ErrPendingExpired)
+		}
+	}()
+
+	c.stateMu.Lock()
+	if c.isClosed || c.isBreakerOpen {
+		c.stateMu.Unlock()
+		return ErrServiceUnavailable
+	}
+	// 发送可能阻塞，不持有锁
+	if c.isConnected {
+		c.stateMu.Unlock()
+		return c.WritePackage(pkg)
+	}
+	defer c.stateMu.Unlock()
+
+	expired = c.expirePendingLocked()
+	if len(c.pending) >= c.buffer.size {
+		return ErrPendingFull
+	}
+	// 参数可能被调用方修改，缓存时编码
+	data, err := marshalJSON(pkg.Body)
+	if err != nil {
+		return err
+	}
+	pkg2 := *pkg
+	pkg2.Body = json.RawMessage(data)
+	c.pending = append(c.pending, pendingMessage{pkg: &pkg2, ts: time.Now()})
+	return nil
+}
+
+func (c *Client) expirePendingLocked() []*Package {
+	var expired []*Package
+	deadline := time.Now().Add(-c.buffer.ttl)
+	for len(c.pending) > 0 && c.pending[0].ts.Before(deadline) {
+		expired = append(expired, c.pending[0].pkg)
+		c.pending = c.pending[1:]
+	}
+	return expired
+}
+
+// 连接成功，恢复熔断。先注册服务及订阅主题，再发送缓存的消息
+func (c *Client) onConnected() {
+	var topics []string
+	if c.name == "router" {
+		topics = c.cm.subscribedTopics()
+	}
+
+	c.stateMu.Lock()
+	reg := c.reg
+	c.stateMu.Unlock()
+	if reg != nil {
+		if err := c.WritePackage(&Package{Id: "C2S_Register", Body: reg}); err != nil {
+			log.Warnf("server %s register error: %v", c.name, err)
+		}
+	}
+	if len(topics) > 0 {
+		if err := c.WritePackage(&Package{Id: "C2S_Subscribe", Body: SubscribeArgs{Topics: topics}}); err != nil {
+			log.Warnf("server %s subscribe error: %v", c.name, err)
+		}
+	}
+
+	// 发送时不持有锁，期间新的消息继续缓存，直到缓存为空后标记已连接，保持消息顺序
+	for {
+		c.stateMu.Lock()
+		expired := c.expirePendingLocked()
+		pending := c.pending
+		c.pending = nil
+		if len(pending) == 0 {
+			c.failures = 0
+			c.isBreakerOpen = false
+			c.isConnected = true
+		}
+		c.stateMu.Unlock()
+
+		for _, pkg := range expired {
+			c.cm.routeFail(c.name, pkg, ErrPendingExpired)
+		}
+		if len(pending) == 0 {
+			return
+		}
+		for _, msg := range pending {
+			if err := c.WritePackage(msg.pkg); err != nil {
+				log.Warnf("server %s write pending %s error: %v", c.name, msg.pkg.Id, err)
+			}
+		}
+	}
+}
+
+func (c *Client) onDisconnected() {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.isConnected = false
+}
+
+// 连接失败，达到次数后熔断并丢弃缓存的消息
+func (c *Client) onConnectFailed() {
+	var dropped []*Package
+	var err error
+
+	c.stateMu.Lock()
+	c.failures++
+	if c.failures >= c.buffer.failures && !c.isBreakerOpen {
+		log.Warnf("server %s connect failed %d times, open breaker", c.name, c.failures)
+		c.isBreakerOpen = true
+		for _, msg := range c.pending {
+			dropped = append(dropped, msg.pkg)
+		}
+		c.pending, err = nil, ErrServiceUnavailable
+	} else {
+		dropped, err = c.expirePendingLocked(), ErrPendingExpired
+	}
+	c.stateMu.Unlock()
+
+	for _, pkg := range dropped {
+		c.cm.routeFail(c.name, pkg, err)
+	}
+}
+
+// 连接已删除，不再缓存消息并丢弃已缓存的消息
+func (c *Client) closePending() {
+	c.stateMu.Lock()
+	c.isClosed = true
+	pending := c.pending
+	c.pending = nil
+	c.stateMu.Unlock()
+
+	for _, msg := range pending {
+		c.cm.routeFail(c.name, msg.pkg, ErrServiceUnavailable)
+	}
+}
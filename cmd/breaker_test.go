@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRouteBreaker(t *testing.T) {
+	router, hall, client := NewNode(), NewNode(), NewNode()
+	routerSrv := &Server{Addr: "mem://test_breaker_router", Node: router}
+	go routerSrv.ListenAndServe()
+	defer routerSrv.Shutdown(context.Background())
+	client.SetRouterAddr("mem://test_breaker_router")
+	client.SetRouteBuffer(time.Minute, 2, 2)
+
+	var mu sync.Mutex
+	var hallAddr string
+	NodeOnWithoutQueue(router, "C2S_GetServerAddr", func(ctx *Context, args *cmdArgs) {
+		mu.Lock()
+		defer mu.Unlock()
+		ctx.WriteJSON("S2C_GetServerAddr", cmdArgs{ServerAddr: hallAddr})
+	})
+	recv := make(chan int, 8)
+	NodeOnWithoutQueue(hall, "TestBreaker", func(ctx *Context, args *testCodecArgs) { recv <- args.N })
+
+	fails := make(chan error, 8)
+	client.OnRouteFail(func(serverName string, pkg *Package, err error) {
+		select {
+		case fails <- err:
+		default:
+		}
+	})
+
+	// 重连期间缓存，超出数量时返回错误
+	for i, expect := range []error{nil, nil, ErrPendingFull} {
+		if err := client.Route("hall", "TestBreaker", &testCodecArgs{N: i}); err != expect {
+			t.Error("route pending", i, err)
+		}
+	}
+	if err := <-fails; err != ErrPendingFull {
+		t.Error("route fail callback", err)
+	}
+	// 多次连接失败后熔断，丢弃缓存的消息
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-fails:
+			if err != ErrServiceUnavailable {
+				t.Error("drop pending", err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("wait breaker open timeout")
+		}
+	}
+	if err := client.Route("hall", "TestBreaker", &testCodecArgs{}); err != ErrServiceUnavailable {
+		t.Error("route when breaker open", err)
+	}
+
+	// 连接成功后恢复
+	hallSrv := &Server{Addr: "mem://test_breaker_hall", Node: hall}
+	go hallSrv.ListenAndServe()
+	defer hallSrv.Shutdown(context.Background())
+	mu.Lock()
+	hallAddr = "mem://test_breaker_hall"
+	mu.Unlock()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if client.Route("hall", "TestBreaker", &testCodecArgs{N: 9}) == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("breaker not closed")
+		}
+	}
+	select {
+	case n := <-recv:
+		if n != 9 {
+			t.Error("recv after breaker closed", n)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait message timeout")
+	}
+}
+
+func TestPendingExpired(t *testing.T) {
+	node := NewNode()
+	node.SetRouteBuffer(time.Millisecond, 8, 8)
+	var errs []error
+	node.OnRouteFail(func(serverName string, pkg *Package, err error) { errs = append(errs, err) })
+
+	client := newClient(node.clients, "hall")
+	client.buffer = node.clients.buffer
+	client.route(&Package{Id: "TestExpired"})
+	time.Sleep(5 * time.Millisecond)
+	client.onConnectFailed()
+	if len(errs) != 1 || errs[0] != ErrPendingExpired || len(client.pending) != 0 {
+		t.Error("pending expired", errs)
+	}
+}
+
+func TestRouteRemovedPool(t *testing.T) {
+	node := NewNode()
+	var errs []error
+	node.OnRouteFail(func(serverName string, pkg *Package, err error) { errs = append(errs, err) })
+
+	cm := node.clients
+	pool := newClientPool(cm, "hall", poolConfig{})
+	client := pool.clients[0]
+	client.route(&Package{Id: "TestRemoved"})
+	cm.removePool(pool)
+	if len(errs) != 1 || errs[0] != ErrServiceUnavailable {
+		t.Error("drop pending", errs)
+	}
+	// 连接已删除，不再缓存
+	if err := client.route(&Package{Id: "TestRemoved"}); err != ErrServiceUnavailable || len(client.pending) != 0 {
+		t.Error("route removed client", err)
+	}
+}
+
+func TestPendingFlushOrder(t *testing.T) {
+	node := NewNode()
+	client := newClient(node.clients, "hall")
+	client.buffer = node.clients.buffer
+	for i := 0; i < 3; i++ {
+		client.route(&Package{Id: "TestFlush", Body: &testCodecArgs{N: i}})
+	}
+	client.onConnected()
+	client.route(&Package{Id: "TestFlush", Body: &testCodecArgs{N: 3}})
+
+	for i := 0; i < 4; i++ {
+		pkg, err := unmarshalPackage(<-client.send.C())
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := &testCodecArgs{}
+		if unmarshalData(pkg.Data, args); args.N != i {
+			t.Error("flush pending order", i, args.N)
+		}
+	}
+}
@@ -2,7 +2,7 @@ package cmd
 
 import (
 	"context"
-	"net"
+	"encoding/json"
 	"sync"
 	"time"
 
@@ -12,16 +12,30 @@ import (
 type Client struct {
 	*TCPConn
 
+	cm   *clientManage
+	pool *clientPool
 	name string
-	reg  interface{} // 连接成功后发送的第一个请求
+	reg  interface{} // 连接成功后发送的第一个请求，stateMu保护
+
+	calls  map[uint64]chan *Package // 等待回复的同步请求
+	callMu sync.Mutex
+
+	// 重连期间缓存消息，多次失败后熔断
+	stateMu       sync.Mutex
+	isConnected   bool
+	isBreakerOpen bool
+	isClosed      bool // 连接池已删除
+	failures      int
+	pending       []pendingMessage
+	buffer        routeBuffer
 }
 
-func newClient(name string) *Client {
+func newClient(cm *clientManage, name string) *Client {
 	client := &Client{
-		name: name,
-		TCPConn: &TCPConn{
-			send: make(chan []byte, sendQueueSize),
-		},
+		cm:      cm,
+		name:    name,
+		TCPConn: newTCPConn("", nil),
+		calls:   make(map[uint64]chan *Package),
 	}
 	return client
 }
@@ -31,22 +45,28 @@ func (c *Client) ServerName() string {
 }
 
 func (c *Client) start() {
+	c.setCodec(nil) // 重连后重新协商
+	c.setCompress(nil, 0)
 	doneCtx, cancel := context.WithCancel(context.Background())
 	go func() {
 		ticker := time.NewTicker(pingPeriod)
 		defer func() {
+			c.onDisconnected()
 			ticker.Stop() // 关闭定时器
 			c.rwc.Close() // 关闭连接
+			c.cancelCalls()
 
 			// 关闭后，自动重连，并消息通知
-			defaultCmdSet.Handle(&Context{Out: c}, "CMD_AutoConnect", nil)
-			defaultCmdSet.Handle(&Context{Out: c}, "FUNC_ServerClose", nil)
+			node := c.cm.node
+			node.Handle(&Context{Out: c}, "CMD_AutoConnect", nil)
+			node.Handle(&Context{Out: c}, "FUNC_ServerClose", nil)
 		}()
 
-		// 第一个包发送校验数据
+		// 第一个包发送校验数据，同时请求协商编码
 		pkg := &Package{
 			SignType: "md5",
 			ExpireTs: time.Now().Add(5 * time.Second).Unix(),
+			Body:     &authArgs{Codec: defaultCodecName, Compress: defaultCompressName},
 		}
 		firstMsg, _ := pkg.Encode()
 		if _, err := c.writeMsg(AuthMessage, firstMsg); err != nil {
@@ -54,11 +74,11 @@ func (c *Client) start() {
 		}
 		for {
 			select {
-			case buf, ok := <-c.send:
+			case buf, ok := <-c.send.C():
 				if !ok {
 					return
 				}
-				if _, err := c.writeMsg(RawMessage, buf); err != nil {
+				if _, err := c.writeRaw(buf); err != nil {
 					return
 				}
 			case <-ticker.C: // heart beat
@@ -80,14 +100,35 @@ func (c *Client) start() {
 			log.Debugf("read %v", err)
 			return
 		}
+		// 服务端确认协商结果，此前的消息仍使用JSON编码
+		if mt == AuthMessage {
+			pkg, err := defaultAuthParser.Decode(buf)
+			if err != nil || c.checkNonce(pkg) != nil {
+				return
+			}
+			args := &authArgs{}
+			json.Unmarshal(pkg.Data, args)
+			if codec := GetCodec(args.Codec); codec != nil {
+				c.setCodec(codec)
+			}
+			if compressor := GetCompressor(args.Compress); compressor != nil {
+				c.setCompress(compressor, args.Threshold)
+			}
+		}
 		if mt == RawMessage {
-			pkg, err := defaultRawParser.Decode(buf)
-			if err != nil {
+			pkg, err := unmarshalPackage(buf)
+			if err != nil || c.checkNonce(pkg) != nil {
 				return
 			}
+			// 同步请求的回复
+			if pkg.ReqId != 0 && c.replyCall(pkg) {
+				continue
+			}
 
 			id, ssid, data := pkg.Id, pkg.Ssid, pkg.Data
-			err = defaultCmdSet.Handle(&Context{Out: c, Ssid: ssid}, id, data)
+			ctx := &Context{Out: c, Ssid: ssid, Version: pkg.Version}
+			ctx.continueTrace(pkg)
+			err = c.cm.node.Handle(ctx, id, data)
 			if err != nil {
 				log.Debugf("handle message[%s] %v", id, err)
 			}
@@ -96,50 +137,58 @@ func (c *Client) start() {
 }
 
 type clientManage struct {
-	clients map[string]*Client // 已存在的连接不会被删除
-	mu      sync.RWMutex
+	pools       map[string]*clientPool // 服务消失且空闲的连接将删除
+	poolConfigs map[string]poolConfig
+	idleTimeout time.Duration
+	buffer      routeBuffer
+	onRouteFail RouteFailFunc
+	topics      map[string]bool // 订阅的主题
+	mu          sync.RWMutex
+	node        *Node
 }
 
-var defaultClientManage = &clientManage{
-	clients: make(map[string]*Client),
+// 服务不可用时返回错误，同时回调
+func (cm *clientManage) Route(serverName string, pkg *Package) error {
+	client := cm.getClient(serverName, pkg.Ssid)
+	if err := client.route(pkg); err != nil {
+		cm.routeFail(serverName, pkg, err)
+		return err
+	}
+	return nil
 }
 
-func (cm *clientManage) Route(serverName string, data []byte) {
+// 获取连接，不存在时创建并自动连接。ssid用于连接池选择连接
+func (cm *clientManage) getClient(serverName, ssid string) *Client {
 	if serverName == "" {
 		panic("route empty server name")
 	}
 
 	cm.mu.RLock()
-	client, ok := cm.clients[serverName]
+	pool, ok := cm.pools[serverName]
 	cm.mu.RUnlock()
 
 	if !ok {
 		cm.mu.Lock()
-		_, rok := cm.clients[serverName]
+		_, rok := cm.pools[serverName]
 		if !rok {
-			client = newClient(serverName)
-			cm.clients[serverName] = client
+			cm.pools[serverName] = newClientPool(cm, serverName, cm.poolConfigLocked(serverName))
 		}
-		client = cm.clients[serverName]
+		pool = cm.pools[serverName]
 		cm.mu.Unlock()
 		// 防止重复连接
 		if !rok {
-			cm.connect(serverName)
+			for _, client := range pool.clients {
+				cm.connect(client)
+			}
 		}
 	}
-
-	if err := client.Write(data); err != nil {
-		log.Errorf("server %s write %s error: %v", serverName, data, err)
-	}
+	return pool.pick(ssid)
 }
 
 // 第一步向路由查询地址
 // 第二步建立连接
-func (cm *clientManage) connect(serverName string) {
-	cm.mu.RLock()
-	client := cm.clients[serverName]
-	cm.mu.RUnlock()
-
+func (cm *clientManage) connect(client *Client) {
+	serverName, pool := client.name, client.pool
 	go func() {
 		intervals := []int{100, 400, 1600, 3200, 5000}
 		for retry := 0; true; retry++ {
@@ -151,41 +200,70 @@ func (cm *clientManage) connect(serverName string) {
 			// 断线后等待一定时候后再重连
 			time.Sleep(time.Duration(ms) * time.Millisecond)
 
-			addr, err := RequestServerAddr(serverName)
+			if pool.closed() {
+				return
+			}
+			addr, err := cm.node.RequestServerAddr(serverName)
 			if err != nil {
 				log.Errorf("connect %s %v", serverName, err)
 			}
+			// 服务已不存在且无新消息
+			if err == nil && addr == "" && pool.isIdle() {
+				log.Infof("server %s disappeared, remove idle connections", serverName)
+				cm.removePool(pool)
+				return
+			}
 
 			if addr != "" {
-				rwc, err := net.Dial("tcp", addr)
+				rwc, err := dial(addr)
 				if err == nil {
+					client.mu.Lock()
 					client.rwc = rwc
+					client.mu.Unlock()
 					break
 				}
 			}
+			client.onConnectFailed()
 			log.Infof("connect server %s, retry %d after %dms", serverName, retry, ms)
 		}
+		client.setCodec(nil) // 缓存的消息使用JSON编码
+		client.onConnected()
 		client.start()
 	}()
 }
 
-func (cm *clientManage) Route3(serverName, messageId string, i interface{}) {
+func (cm *clientManage) Route3(serverName, messageId string, i interface{}) error {
 	serverName, messageId = routeMessage(serverName, messageId)
 
 	pkg := &Package{Id: messageId, Body: i}
-	msg, err := pkg.Encode()
-	if err != nil {
-		return
-	}
-	cm.Route(serverName, msg)
+	return cm.Route(serverName, pkg)
 }
 
+// 已连接时立即注册，否则连接成功后注册
 func (cm *clientManage) RegisterService(reg *ServiceConfig) {
-	cm.Route3("router", "C2S_Register", reg)
-	cm.mu.Lock()
-	client := cm.clients["router"]
+	client := cm.getClient("router", "")
+	client.stateMu.Lock()
 	client.reg = reg
-	cm.mu.Unlock()
+	isConnected := client.isConnected
+	client.stateMu.Unlock()
+
+	if isConnected {
+		cm.Route3("router", "C2S_Register", reg)
+	}
+}
+
+// 从路由注销服务，断线重连后不再注册
+func (cm *clientManage) UnregisterService(ctx context.Context) error {
+	cm.mu.RLock()
+	pool := cm.pools["router"]
+	cm.mu.RUnlock()
+	if pool != nil {
+		client := pool.clients[0]
+		client.stateMu.Lock()
+		client.reg = nil
+		client.stateMu.Unlock()
+	}
+	return cm.Call(ctx, "router", "C2S_Unregister", struct{}{}, nil)
 }
 
 // Client自动重连
@@ -193,12 +271,11 @@ func funcAutoConnect(ctx *Context, data interface{}) {
 	client := ctx.Out.(*Client)
 	// ctx.Out.Close()
 
-	cm := defaultClientManage
-	reg, name := client.reg, client.name
-	if reg != nil && name == "router" {
-		cm.Route3(name, "C2S_Register", reg)
+	if client.pool.closed() {
+		return
 	}
-	cm.connect(name)
+	// 重连成功后重新注册
+	client.cm.connect(client)
 }
 
 func funcRegister(ctx *Context, data interface{}) {
@@ -1,14 +1,13 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"net"
-	"reflect"
-	"runtime"
-	"strings"
+	"time"
 
 	"github.com/guogeer/quasar/config"
+	"github.com/guogeer/quasar/log"
 )
 
 var (
@@ -30,57 +29,131 @@ func init() {
 		h.key = productKey
 	}
 	defaultRawParser.compressPackage = cfg.CompressPackage
+	if cfg.SignMode == "hmac" {
+		enableHMACSign = true
+		// 第一个密钥用于签名
+		var signKeyId, productKeyId string
+		signKeys, productKeys := map[string]string{}, map[string]string{}
+		for i, k := range cfg.SignKeys {
+			if i == 0 {
+				signKeyId = k.Id
+			}
+			signKeys[k.Id] = k.Key
+		}
+		for i, k := range cfg.ProductKeys {
+			if i == 0 {
+				productKeyId = k.Id
+			}
+			productKeys[k.Id] = k.Key
+		}
+		if err := defaultAuthParser.setHMACKeys(signKeyId, signKeys); err != nil {
+			log.Fatalf("sign keys %v", err)
+		}
+		if err := defaultHashParser.setHMACKeys(productKeyId, productKeys); err != nil {
+			log.Fatalf("product keys %v", err)
+		}
+	}
+	for _, bp := range cfg.Backpressures {
+		policy, ok := backpressurePolicies[bp.Policy]
+		if !ok {
+			log.Fatalf("invalid backpressure policy %s", bp.Policy)
+		}
+		SetBackpressure(bp.Type, policy, time.Duration(bp.Timeout)*time.Millisecond)
+	}
+	for _, pool := range cfg.ClientPools {
+		select_, ok := poolSelects[pool.Select]
+		if pool.Select != "" && !ok {
+			log.Fatalf("invalid client pool select %s", pool.Select)
+		}
+		DefaultNode().SetClientPool(pool.Server, pool.Size, select_)
+	}
+	// 未配置时使用默认值
+	rb := cfg.RouteBuffer
+	DefaultNode().SetRouteBuffer(time.Duration(rb.TTL)*time.Millisecond, rb.Size, rb.BreakerFailures)
+	if cfg.MaxMessageSize > 0 {
+		maxMessageSize = cfg.MaxMessageSize
+	}
+	// 服务内部连接请求协商的编码
+	if cfg.Codec != "" {
+		defaultCodecName = cfg.Codec
+	}
+	defaultCompressName = cfg.Compress
 	if cfg.EnableDebug {
 		enableDebug = true
 	}
+	if cfg.EnablePanicReply {
+		enablePanicReply = true
+	}
+	if cfg.Trace.Enable {
+		enableTrace = true
+	}
+	if path := cfg.Trace.SpanFile; path != "" {
+		if err := openSpanSink(path); err != nil {
+			log.Fatalf("open span file %v", err)
+		}
+	}
+	if rc := cfg.Record; rc.File != "" {
+		if err := StartRecord(rc.File, int64(rc.MaxSize)<<20, rc.MaxBackups); err != nil {
+			log.Fatalf("start record %v", err)
+		}
+	}
+	if cfg.Workers > 0 {
+		DefaultNode().SetWorkers(cfg.Workers)
+	}
 	if addr := config.Config().Server("router").Addr; addr != "" {
 		defaultRouterAddr = addr
 	}
-
-	// 断线后自动重连
-	BindWithName("C2S_RegisterOk", funcRegister, (*cmdArgs)(nil))
-	BindWithName("CMD_AutoConnect", funcAutoConnect, (*cmdArgs)(nil))
-	BindWithName("CMD_Close", funcClose, (*cmdArgs)(nil))
+	if srvConfig, cliConfig, err := loadTLSConfig(); err != nil {
+		log.Fatalf("load tls config %v", err)
+	} else {
+		serverTLSConfig, clientTLSConfig = srvConfig, cliConfig
+	}
 }
 
 func BindWithName(name string, h Handler, args interface{}) {
-	defaultCmdSet.Bind(name, h, args, true)
+	DefaultNode().BindWithName(name, h, args)
 }
 
 func Hook(h Handler) {
-	defaultCmdSet.Hook(h)
+	DefaultNode().Hook(h)
+}
+
+func Use(mws ...Middleware) {
+	DefaultNode().Use(mws...)
+}
+
+func UseFor(prefix string, mws ...Middleware) {
+	DefaultNode().UseFor(prefix, mws...)
 }
 
 // 消息不入队列直接处理
 func BindWithoutQueue(name string, h Handler, args interface{}) {
-	defaultCmdSet.Bind(name, h, args, false)
+	DefaultNode().BindWithoutQueue(name, h, args)
 }
 
 func Bind(h Handler, args interface{}) {
-	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
-	n := strings.LastIndexByte(name, '.')
-	if n >= 0 {
-		name = name[n+1:]
-	}
-	// log.Debug("method name =", name)
-	BindWithName(name, h, args)
+	DefaultNode().Bind(h, args)
 }
 
 func Handle(ctx *Context, name string, data []byte) error {
-	return defaultCmdSet.Handle(ctx, name, data)
+	return DefaultNode().Handle(ctx, name, data)
 }
 
-func Route(serverName, messageId string, data interface{}) {
-	defaultClientManage.Route3(serverName, messageId, data)
+func Route(serverName, messageId string, data interface{}) error {
+	return DefaultNode().Route(serverName, messageId, data)
 }
 
 func RegisterService(config *ServiceConfig) {
-	defaultClientManage.RegisterService(config)
+	DefaultNode().RegisterService(config)
+}
+
+func UnregisterService(ctx context.Context) error {
+	return DefaultNode().UnregisterService(ctx)
 }
 
 type ServiceConfig struct {
 	ServerName string      `json:",omitempty"`
-	ServerAddr string      `json:",omitempty"`
+	ServerAddr string      `json:",omitempty"` // 多个地址以逗号分隔，支持unix://path
 	ServerData interface{} `json:",omitempty"`
 	ServerType string      `json:",omitempty"` // center,gateway etc
 	IsRandPort bool        `json:",omitempty"` // Deprecated: 服务合并后指定端口，不再需要随机端口
@@ -97,95 +170,33 @@ type ForwardArgs struct {
 	Data       json.RawMessage
 }
 
-// 消息通过router转发
+// 消息通过router转发。开启追踪时创建新的链路，处理消息时使用ctx.Forward透传
 func Forward(servers interface{}, messageId string, i interface{}) {
-	buf, err := marshalJSON(i)
-	if err != nil {
-		return
-	}
-
-	var serverList []string
-	switch v := servers.(type) {
-	case string:
-		serverList = []string{v}
-	case []string:
-		serverList = v
-	}
-	if len(serverList) == 0 {
-		return
-	}
-
-	args := &ForwardArgs{
-		ServerList: serverList,
-		Name:       messageId,
-		Data:       buf,
-	}
-	Route("router", "C2S_Route", args)
+	DefaultNode().Forward(servers, messageId, i)
 }
 
 // 同步请求
 func Request(serverName, msgId string, in interface{}) ([]byte, error) {
-	var addr string
-	if serverName == "router" {
-		addr = defaultRouterAddr
-	} else {
-		addr, _ = RequestServerAddr(serverName)
-	}
-	if addr == "" {
-		return nil, errInvalidAddr
-	}
-	rwc, err := net.Dial("tcp", addr)
-	if err != nil {
-		return nil, err
-	}
-	defer rwc.Close()
-
-	c := &TCPConn{rwc: rwc}
-	// 第一个包发送校验数据
-	firstPackage, _ := defaultAuthParser.Encode(&Package{})
-	if _, err := c.writeMsg(AuthMessage, firstPackage); err != nil {
-		return nil, err
-	}
-	req := &Package{Id: msgId, Body: in}
-	buf, err := defaultRawParser.Encode(req)
-	if err != nil {
-		return nil, err
-	}
-	if _, err := c.writeMsg(RawMessage, buf); err != nil {
-		return nil, err
-	}
-
-	// read message, ignore heart beat message
-	for i := 0; i < 8; i++ {
-		mt, buf, err := c.ReadMessage()
-		if err != nil {
-			return nil, err
-		}
-		if mt == RawMessage {
-			pkg, err := defaultRawParser.Decode(buf)
-			if err != nil {
-				return nil, err
-			}
-			return pkg.Data, err
-		}
-	}
-	return nil, errors.New("unkown error")
+	return DefaultNode().Request(serverName, msgId, in)
 }
 
 // 向路由请求服务器地址
 func RequestServerAddr(name string) (string, error) {
-	if name == "router" {
-		return defaultRouterAddr, nil
-	}
+	return DefaultNode().RequestServerAddr(name)
+}
 
-	req := cmdArgs{ServerName: name}
-	buf, err := Request("router", "C2S_GetServerAddr", req)
-	if err != nil {
-		return "", err
-	}
-	args := &cmdArgs{}
-	if err := json.Unmarshal(buf, args); err != nil {
-		return "", err
-	}
-	return args.ServerAddr, nil
+func RunOnce() {
+	DefaultNode().RunOnce()
+}
+
+func Drain() {
+	DefaultNode().Drain()
+}
+
+func Enqueue(ctx *Context, h Handler, args interface{}) {
+	DefaultNode().Enqueue(ctx, h, args)
+}
+
+func GetMessageQueue() *SafeQueue {
+	return DefaultNode().GetMessageQueue()
 }
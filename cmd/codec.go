@@ -0,0 +1,244 @@
+package cmd
+
+// 2021-07-02 消息编码可替换，连接建立时在AuthMessage中协商
+// 2026-10-18 二进制编码的消息体使用MessagePack格式，见msgpack.go
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errInvalidCodec = errors.New("invalid codec data")
+	errUnknownCodec = errors.New("unknown codec")
+
+	defaultCodec        = Codec(jsonCodec{})
+	defaultCodecName    = "json" // 客户端请求协商的编码
+	defaultCompressName = ""     // 客户端请求协商的压缩算法，空时不压缩
+
+	codecs        = map[string]Codec{}
+	codecsByMagic = map[byte]Codec{}
+	codecMu       sync.RWMutex
+)
+
+// 编码器
+// 编码后首字节用于识别编码格式，接收方根据首字节解码
+type Codec interface {
+	Name() string
+	Magic() byte
+	Marshal(pkg *Package) ([]byte, error)
+	Unmarshal(buf []byte) (*Package, error)
+}
+
+func init() {
+	RegisterCodec(jsonCodec{})
+	RegisterCodec(binaryCodec{})
+}
+
+func RegisterCodec(c Codec) {
+	codecMu.Lock()
+	defer codecMu.Unlock()
+	codecs[c.Name()] = c
+	codecsByMagic[c.Magic()] = c
+}
+
+func GetCodec(name string) Codec {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+	return codecs[name]
+}
+
+// 根据首字节选择编码器解码
+func unmarshalPackage(buf []byte) (*Package, error) {
+	if len(buf) == 0 {
+		return nil, errInvalidCodec
+	}
+	codecMu.RLock()
+	c, ok := codecsByMagic[buf[0]]
+	codecMu.RUnlock()
+	if !ok {
+		return nil, errUnknownCodec
+	}
+	return c.Unmarshal(buf)
+}
+
+// JSON编码，默认
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Magic() byte {
+	return '{'
+}
+
+func (jsonCodec) Marshal(pkg *Package) ([]byte, error) {
+	return defaultRawParser.Encode(pkg)
+}
+
+func (jsonCodec) Unmarshal(buf []byte) (*Package, error) {
+	return defaultRawParser.Decode(buf)
+}
+
+// 二进制编码，格式类似protobuf
+// BYTE0：0x80，之后为字段列表，字段头为varint(序号<<3|类型)
+// 类型0：varint；类型2：varint长度+数据
+type binaryCodec struct{}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (binaryCodec) Magic() byte {
+	return 0x80
+}
+
+func (c binaryCodec) Marshal(pkg *Package) ([]byte, error) {
+	body, err := marshalBody(pkg.Body)
+	if err != nil {
+		return nil, err
+	}
+	pkg.Data = body
+
+	buf := make([]byte, 1, 32+len(pkg.Id)+len(pkg.Ssid)+len(pkg.Data))
+	buf[0] = c.Magic()
+	buf = appendBytesField(buf, 1, []byte(pkg.Id))
+	buf = appendBytesField(buf, 2, pkg.Data)
+	buf = appendBytesField(buf, 3, []byte(pkg.Sign))
+	buf = appendBytesField(buf, 4, []byte(pkg.Ssid))
+	buf = appendVarintField(buf, 5, uint64(pkg.Version))
+	buf = appendVarintField(buf, 6, uint64(pkg.ExpireTs))
+	buf = appendBytesField(buf, 7, []byte(pkg.ServerName))
+	buf = appendBytesField(buf, 8, []byte(pkg.ClientAddr))
+	buf = appendVarintField(buf, 9, pkg.ReqId)
+	buf = appendBytesField(buf, 10, []byte(pkg.KeyId))
+	buf = appendBytesField(buf, 11, []byte(pkg.Nonce))
+	buf = appendBytesField(buf, 12, []byte(pkg.TraceId))
+	buf = appendBytesField(buf, 13, []byte(pkg.SpanId))
+	buf = appendVarintField(buf, 14, uint64(pkg.Code))
+	buf = appendBytesField(buf, 15, []byte(pkg.Err))
+	return buf, nil
+}
+
+func (c binaryCodec) Unmarshal(buf []byte) (*Package, error) {
+	if len(buf) == 0 || buf[0] != c.Magic() {
+		return nil, errInvalidCodec
+	}
+	pkg := &Package{}
+	for buf = buf[1:]; len(buf) > 0; {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errInvalidCodec
+		}
+		buf = buf[n:]
+
+		var x uint64
+		var b []byte
+		switch key & 0x7 {
+		case wireVarint:
+			if x, n = binary.Uvarint(buf); n <= 0 {
+				return nil, errInvalidCodec
+			}
+			buf = buf[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < size {
+				return nil, errInvalidCodec
+			}
+			b, buf = buf[n:n+int(size)], buf[n+int(size):]
+		default:
+			return nil, errInvalidCodec
+		}
+
+		// 忽略未知的字段，兼容新增字段
+		switch key >> 3 {
+		case 1:
+			pkg.Id = string(b)
+		case 2:
+			pkg.Data = b
+		case 3:
+			pkg.Sign = string(b)
+		case 4:
+			pkg.Ssid = string(b)
+		case 5:
+			pkg.Version = int(x)
+		case 6:
+			pkg.ExpireTs = int64(x)
+		case 7:
+			pkg.ServerName = string(b)
+		case 8:
+			pkg.ClientAddr = string(b)
+		case 9:
+			pkg.ReqId = x
+		case 10:
+			pkg.KeyId = string(b)
+		case 11:
+			pkg.Nonce = string(b)
+		case 12:
+			pkg.TraceId = string(b)
+		case 13:
+			pkg.SpanId = string(b)
+		case 14:
+			pkg.Code = int(x)
+		case 15:
+			pkg.Err = string(b)
+		}
+	}
+	if ts := pkg.ExpireTs; ts > 0 && ts < time.Now().Unix() {
+		return nil, errPackageExpire
+	}
+	return pkg, nil
+}
+
+// 已编码的数据原样转发，其他使用MessagePack编码
+func marshalBody(i interface{}) ([]byte, error) {
+	switch v := i.(type) {
+	case []byte:
+		return v, nil
+	case json.RawMessage:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return marshalBinary(i)
+}
+
+// 空值不编码
+func appendVarintField(buf []byte, field int, x uint64) []byte {
+	if x == 0 {
+		return buf
+	}
+	buf = appendUvarint(buf, uint64(field<<3|wireVarint))
+	return appendUvarint(buf, x)
+}
+
+func appendBytesField(buf []byte, field int, b []byte) []byte {
+	if len(b) == 0 {
+		return buf
+	}
+	buf = appendUvarint(buf, uint64(field<<3|wireBytes))
+	buf = appendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+// 连接建立时协商的参数，由AuthMessage携带
+type authArgs struct {
+	Codec     string `json:",omitempty"`
+	Compress  string `json:",omitempty"` // 请求时按优先级以逗号分隔，回复协商的算法
+	Threshold int    `json:",omitempty"` // 压缩阈值，回复时携带
+}
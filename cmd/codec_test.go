@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"testing"
+)
+
+type testCodecArgs struct {
+	N int
+	S string
+}
+
+func TestCodecMarshal(t *testing.T) {
+	for _, name := range []string{"json", "binary"} {
+		codec := GetCodec(name)
+		pkg := &Package{
+			Id:         "Test",
+			Ssid:       "abc",
+			Version:    3,
+			ServerName: "hall",
+			ClientAddr: "127.0.0.1:8080",
+			TraceId:    "trace",
+			SpanId:     "span",
+			Code:       CodeBadRequest,
+			Err:        "bad",
+			Body:       &testCodecArgs{N: 1, S: "hello"},
+		}
+		buf, err := codec.Marshal(pkg)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		pkg2, err := unmarshalPackage(buf)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if pkg2.Id != pkg.Id || pkg2.Ssid != pkg.Ssid || pkg2.Version != pkg.Version ||
+			pkg2.ServerName != pkg.ServerName || pkg2.ClientAddr != pkg.ClientAddr ||
+			pkg2.TraceId != pkg.TraceId || pkg2.SpanId != pkg.SpanId ||
+			pkg2.Code != pkg.Code || pkg2.Err != pkg.Err {
+			t.Errorf("%s invalid package %v", name, pkg2)
+		}
+
+		args := &testCodecArgs{}
+		if err := unmarshalData(pkg2.Data, args); err != nil || *args != (testCodecArgs{N: 1, S: "hello"}) {
+			t.Errorf("%s invalid data %s", name, pkg2.Data)
+		}
+	}
+}
+
+func TestBinaryCodecInvalid(t *testing.T) {
+	samples := [][]byte{
+		{0x80, 0x0a},
+		{0x80, 0x0a, 0x05, 'a'},
+		{0x80, 0x0b, 0x01},
+	}
+	for _, sample := range samples {
+		if _, err := unmarshalPackage(sample); err == nil {
+			t.Errorf("decode invalid data %v", sample)
+		}
+	}
+	if _, err := unmarshalPackage([]byte{0x01}); err != errUnknownCodec {
+		t.Error("decode unknown codec", err)
+	}
+}
@@ -0,0 +1,162 @@
+package cmd
+
+// 2021-10-12 二进制帧压缩，替代zlib后base64编码
+// 支持deflate、zlib、gzip及snappy，snappy压缩率略低但速度快得多，适合实时消息
+// 帧格式：1字节压缩算法+数据，算法为0时数据未压缩
+// 客户端握手时协商算法及阈值，未协商时使用原有的文本帧
+// 服务内部连接在AuthMessage中与编码一起协商，压缩后的消息类型为CompressMessage
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+var (
+	errInvalidFrame    = errors.New("invalid frame")
+	errUnknownCompress = errors.New("unknown compression")
+	errTooLargeFrame   = errors.New("too large decompressed frame")
+)
+
+type compressWriter interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+type Compressor struct {
+	id        byte
+	name      string
+	newWriter func(io.Writer) compressWriter
+	newReader func(io.Reader) (io.ReadCloser, error)
+	writers   sync.Pool
+}
+
+// 按客户端优先级协商时的顺序
+var compressors = []*Compressor{
+	{
+		id:        1,
+		name:      "deflate",
+		newWriter: func(w io.Writer) compressWriter { zw, _ := flate.NewWriter(w, flate.DefaultCompression); return zw },
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil },
+	},
+	{
+		id:        2,
+		name:      "zlib",
+		newWriter: func(w io.Writer) compressWriter { return zlib.NewWriter(w) },
+		newReader: zlib.NewReader,
+	},
+	{
+		id:        3,
+		name:      "gzip",
+		newWriter: func(w io.Writer) compressWriter { return gzip.NewWriter(w) },
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+	{
+		id:        4,
+		name:      "snappy",
+		newWriter: func(w io.Writer) compressWriter { return snappy.NewBufferedWriter(w) },
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return io.NopCloser(snappy.NewReader(r)), nil },
+	},
+}
+
+func (c *Compressor) Name() string {
+	return c.name
+}
+
+// 按名称获取压缩算法，不支持时返回nil
+func GetCompressor(name string) *Compressor {
+	for _, c := range compressors {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// 选择客户端列表中第一个支持的算法，多个算法以逗号分隔
+func NegotiateCompressor(accept string) *Compressor {
+	for _, name := range strings.Split(accept, ",") {
+		if c := GetCompressor(strings.TrimSpace(name)); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// 默认的压缩阈值，即配置CompressPackage
+func DefaultCompressThreshold() int {
+	return defaultRawParser.compressPackage
+}
+
+func (c *Compressor) compress(buf []byte) ([]byte, error) {
+	out := &bytes.Buffer{}
+	out.WriteByte(c.id)
+
+	w, _ := c.writers.Get().(compressWriter)
+	if w == nil {
+		w = c.newWriter(out)
+	} else {
+		w.Reset(out)
+	}
+	defer c.writers.Put(w)
+
+	if _, err := w.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// 编码二进制帧，超过阈值时压缩。c为空或阈值不大于0时不压缩
+func EncodeFrame(c *Compressor, threshold int, buf []byte) ([]byte, error) {
+	if c != nil && threshold > 0 && len(buf) > threshold {
+		return c.compress(buf)
+	}
+	frame := make([]byte, len(buf)+1)
+	copy(frame[1:], buf)
+	return frame, nil
+}
+
+// 解码二进制帧，解压后的数据不超过limit
+func DecodeFrame(frame []byte, limit int) ([]byte, error) {
+	if len(frame) == 0 {
+		return nil, errInvalidFrame
+	}
+	if frame[0] == 0 {
+		return frame[1:], nil
+	}
+
+	var c *Compressor
+	for _, c2 := range compressors {
+		if c2.id == frame[0] {
+			c = c2
+		}
+	}
+	if c == nil {
+		return nil, errUnknownCompress
+	}
+	r, err := c.newReader(bytes.NewReader(frame[1:]))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// 防止压缩炸弹
+	buf, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > limit {
+		return nil, errTooLargeFrame
+	}
+	return buf, nil
+}
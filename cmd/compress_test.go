@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressFrame(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"N":1,"S":"hello world"}`), 64)
+	for _, name := range []string{"deflate", "zlib", "gzip", "snappy"} {
+		c := GetCompressor(name)
+		for i := 0; i < 2; i++ {
+			frame, err := EncodeFrame(c, 128, data)
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			if frame[0] == 0 || len(frame) >= len(data) {
+				t.Errorf("%s compress %d -> %d", name, len(data), len(frame))
+			}
+			buf, err := DecodeFrame(frame, len(data))
+			if err != nil || !bytes.Equal(buf, data) {
+				t.Error(name, "decode frame", err)
+			}
+		}
+		frame, _ := EncodeFrame(c, 128, data)
+		if _, err := DecodeFrame(frame, len(data)-1); err != errTooLargeFrame {
+			t.Error(name, "decode too large frame", err)
+		}
+	}
+
+	frame, _ := EncodeFrame(GetCompressor("gzip"), len(data), data)
+	if buf, err := DecodeFrame(frame, len(data)); frame[0] != 0 || err != nil || !bytes.Equal(buf, data) {
+		t.Error("frame below threshold", err)
+	}
+	if _, err := DecodeFrame([]byte{9, 1}, 8); err != errUnknownCompress {
+		t.Error("unknown compression", err)
+	}
+	if c := NegotiateCompressor("br, gzip,deflate"); c == nil || c.Name() != "gzip" {
+		t.Error("negotiate compressor", c)
+	}
+	if c := NegotiateCompressor("br"); c != nil {
+		t.Error("negotiate unsupported compressor", c)
+	}
+}
+
+// 服务内部连接握手时协商压缩
+func TestConnCompress(t *testing.T) {
+	defaultCompressName, defaultRawParser.compressPackage = "br,snappy", 64
+	defer func() { defaultCompressName, defaultRawParser.compressPackage = "", 0 }()
+
+	server, client := NewNode(), NewNode()
+	srv := &Server{Addr: "mem://test_compress", Node: server}
+	go srv.ListenAndServe()
+	defer srv.Shutdown(context.Background())
+	client.SetRouterAddr("mem://test_compress")
+
+	NodeOnWithoutQueue(server, "TestCompress", func(ctx *Context, args *testCodecArgs) {
+		ctx.WriteJSON("TestCompress", args)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	in, out := &testCodecArgs{N: 1, S: strings.Repeat("compress ", 64)}, &testCodecArgs{}
+	for i := 0; i < 2; i++ {
+		if err := client.Call(ctx, "router", "TestCompress", in, out); err != nil || *out != *in {
+			t.Fatal("call with compress", err)
+		}
+	}
+	c := client.clients.getClient("router", "")
+	c.mu.RLock()
+	frame := c.frame
+	c.mu.RUnlock()
+	if frame.compressor == nil || frame.compressor.Name() != "snappy" || frame.threshold != 64 {
+		t.Error("negotiate compress", frame)
+	}
+}
+
+func TestCompressMessage(t *testing.T) {
+	r, w := net.Pipe()
+	defer r.Close()
+	defer w.Close()
+
+	data := bytes.Repeat([]byte("compress "), 64)
+	go func() {
+		c := &TCPConn{rwc: w}
+		c.setCompress(GetCompressor("gzip"), 64)
+		c.writeRaw(data)
+		c.writeRaw(data[:8])
+	}()
+	c := &TCPConn{rwc: r}
+	for _, n := range []int{len(data), 8} {
+		mt, buf, err := c.ReadMessage()
+		if err != nil || mt != RawMessage || !bytes.Equal(buf, data[:n]) {
+			t.Fatal("read compressed message", mt, len(buf), err)
+		}
+	}
+}
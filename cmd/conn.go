@@ -2,34 +2,38 @@ package cmd
 
 import (
 	"encoding/binary"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"reflect"
 	"sync"
 	"time"
-
-	"github.com/guogeer/quasar/log"
 )
 
 // 协议格式，前4个字节
-// BYTE0：消息类型，BYTE1-3：消息长度
+// BYTE0：消息类型，BYTE1-2：消息长度，BYTE3：保留
+// 2021-07-16 超过单帧长度的消息拆分为多个FragmentMessage帧，最后一帧为原消息类型
 
 const (
 	pongWait        = 60 * time.Second
 	pingPeriod      = (pongWait * 9) / 10
-	maxMessageSize  = 96 << 10 // 96K
+	maxFrameSize    = 60 << 10 // 单帧最大60K
 	sendQueueSize   = 32 << 10
 	messageHeadSize = 4
 )
 
+// 分片重组后的消息最大长度
+var maxMessageSize = 4 << 20 // 4M
+
 const (
-	RawMessage   = 0x01
-	CloseMessage = 0xf0
-	PingMessage  = 0xf1
-	PongMessage  = 0xf2
-	AuthMessage  = 0xf3
+	RawMessage      = 0x01
+	FragmentMessage = 0x02 // 分片，后续仍有数据
+	CompressMessage = 0x03 // 二进制帧格式，见EncodeFrame，读取时解压为RawMessage
+	CloseMessage    = 0xf0
+	PingMessage     = 0xf1
+	PongMessage     = 0xf2
+	AuthMessage     = 0xf3
 )
 
 type Conn interface {
@@ -40,20 +44,80 @@ type Conn interface {
 }
 
 type TCPConn struct {
-	rwc     net.Conn
-	ssid    string
-	send    chan []byte
-	isClose bool
-	mu      sync.RWMutex
+	rwc    net.Conn
+	ssid   string
+	send   *SendQueue
+	codec  Codec        // 握手协商后的编码，默认JSON
+	frame  frameConfig  // 握手协商后的压缩，默认不压缩
+	nonces *NonceWindow // 连接内已使用的Nonce
+	mu     sync.RWMutex
 }
 
-func (c *TCPConn) Close() {
+func newTCPConn(ssid string, rwc net.Conn) *TCPConn {
+	return &TCPConn{
+		ssid: ssid,
+		rwc:  rwc,
+		send: NewSendQueue(sendQueueSize, GetBackpressure("tcp")),
+	}
+}
+
+func (c *TCPConn) getCodec() Codec {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.codec == nil {
+		return defaultCodec
+	}
+	return c.codec
+}
+
+func (c *TCPConn) setCodec(codec Codec) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.codec = codec
+}
+
+// 签名的消息校验重放，未签名的内部消息忽略
+func (c *TCPConn) checkNonce(pkg *Package) error {
+	if pkg.Sign == "" {
+		return nil
+	}
+	c.mu.Lock()
+	if c.nonces == nil {
+		c.nonces = NewNonceWindow()
+	}
+	nonces := c.nonces
+	c.mu.Unlock()
+	return nonces.Check(pkg)
+}
+
+type frameConfig struct {
+	compressor *Compressor
+	threshold  int
+}
+
+func (c *TCPConn) setCompress(compressor *Compressor, threshold int) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if !c.isClose {
-		c.isClose = true
-		close(c.send)
+	c.frame = frameConfig{compressor: compressor, threshold: threshold}
+}
+
+// 协商压缩后超过阈值的消息压缩，在写协程调用
+func (c *TCPConn) writeRaw(buf []byte) (int, error) {
+	c.mu.RLock()
+	frame := c.frame
+	c.mu.RUnlock()
+	if frame.compressor == nil {
+		return c.writeMsg(RawMessage, buf)
+	}
+	buf, err := EncodeFrame(frame.compressor, frame.threshold, buf)
+	if err != nil {
+		return 0, err
 	}
+	return c.writeMsg(CompressMessage, buf)
+}
+
+func (c *TCPConn) Close() {
+	c.send.Close()
 }
 
 func (c *TCPConn) RemoteAddr() string {
@@ -62,48 +126,86 @@ func (c *TCPConn) RemoteAddr() string {
 
 func (c *TCPConn) ReadMessage() (mt uint8, buf []byte, err error) {
 	var head [messageHeadSize]byte
-	// read message
-	if _, err = io.ReadFull(c.rwc, head[:]); err != nil {
-		return
-	}
-
-	n := int(binary.BigEndian.Uint16(head[1:]))
+	for {
+		// read message
+		if _, err = io.ReadFull(c.rwc, head[:]); err != nil {
+			return
+		}
 
-	// 消息
-	mt = uint8(head[0])
-	switch mt {
-	case PingMessage, PongMessage, CloseMessage:
-		return
-	case AuthMessage, RawMessage:
-		if n > 0 && n < maxMessageSize {
-			buf = make([]byte, n)
-			if _, err = io.ReadFull(c.rwc, buf); err == nil {
+		n := int(binary.BigEndian.Uint16(head[1:]))
+		// 消息
+		mt = uint8(head[0])
+		switch mt {
+		case PingMessage, PongMessage, CloseMessage:
+			if len(buf) == 0 {
+				return
+			}
+		case FragmentMessage, AuthMessage, RawMessage, CompressMessage:
+			if n > 0 && len(buf)+n <= maxMessageSize {
+				frame := make([]byte, n)
+				if _, err = io.ReadFull(c.rwc, frame); err != nil {
+					return
+				}
+				if buf == nil {
+					buf = frame
+				} else {
+					buf = append(buf, frame...)
+				}
+				// 等待后续分片
+				if mt == FragmentMessage {
+					continue
+				}
+				if mt == CompressMessage {
+					mt = RawMessage
+					buf, err = DecodeFrame(buf, maxMessageSize)
+				}
 				return
 			}
 		}
+		err = errors.New("invalid data")
+		return
 	}
-	err = errors.New("invalid data")
-	return
 }
 
 func (c *TCPConn) NewMessageBytes(mt int, data []byte) ([]byte, error) {
 	if len(data) > maxMessageSize {
 		return nil, errTooLargeMessage
 	}
-	buf := make([]byte, len(data)+messageHeadSize)
+	frames := (len(data) + maxFrameSize - 1) / maxFrameSize
+	if frames == 0 {
+		frames = 1
+	}
+	buf := make([]byte, 0, len(data)+frames*messageHeadSize)
+	for {
+		frameType, frame := mt, data
+		if len(data) > maxFrameSize {
+			frameType, frame = FragmentMessage, data[:maxFrameSize]
+		}
+		data = data[len(frame):]
 
-	// 协议头
-	buf[0] = byte(mt)
-	binary.BigEndian.PutUint16(buf[1:messageHeadSize], uint16(len(data)))
-	// 协议数据
-	copy(buf[messageHeadSize:], data)
-	return buf, nil
+		// 协议头
+		var head [messageHeadSize]byte
+		head[0] = byte(frameType)
+		binary.BigEndian.PutUint16(head[1:], uint16(len(frame)))
+		buf = append(buf, head[:]...)
+		// 协议数据
+		buf = append(buf, frame...)
+		if frameType != FragmentMessage {
+			return buf, nil
+		}
+	}
 }
 
 func (c *TCPConn) WriteJSON(name string, i interface{}) error {
 	// 消息格式
 	pkg := &Package{Id: name, Body: i}
-	buf, err := defaultRawParser.Encode(pkg)
+	return c.WritePackage(pkg)
+}
+
+// 使用连接协商的编码发送消息
+func (c *TCPConn) WritePackage(pkg *Package) error {
+	RecordSend(pkg)
+	buf, err := c.getCodec().Marshal(pkg)
 	if err != nil {
 		return err
 	}
@@ -111,17 +213,21 @@ func (c *TCPConn) WriteJSON(name string, i interface{}) error {
 }
 
 func (c *TCPConn) Write(data []byte) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.isClose {
-		return errors.New("connection is closed")
+	if len(data) > maxMessageSize {
+		return errTooLargeMessage
 	}
-	select {
-	case c.send <- data:
-	default:
-		return errors.New("write too busy")
+
+	err := c.send.Push(data)
+	if err == ErrSendDisconnect {
+		c.mu.RLock()
+		rwc := c.rwc
+		c.mu.RUnlock()
+		// 未建立连接时仅丢弃消息
+		if rwc != nil {
+			rwc.Close()
+		}
 	}
-	return nil
+	return err
 }
 
 func (c *TCPConn) writeMsg(mt int, msg []byte) (int, error) {
@@ -137,41 +243,52 @@ type Handler func(*Context, interface{})
 type cmdEntry struct {
 	h           Handler
 	type_       reflect.Type
-	isPushQueue bool // 请求入消息队列处理
+	rules       *structRules // 参数校验规则
+	isPushQueue bool         // 请求入消息队列处理
+	chained     Handler      // 包含中间件的处理函数，注册及Use时重建
+
+	minVersion, maxVersion int // 版本范围，BindVersion注册时有效
 }
 
 type CmdSet struct {
-	e  map[string]*cmdEntry
-	mu sync.RWMutex
+	e        map[string]*cmdEntry
+	versions map[string][]*cmdEntry // 按版本注册，按最低版本排序
+	mu       sync.RWMutex
+	node     *Node
 
-	hook Handler // 调用顺序：hook->bind
+	middlewares []prefixMiddleware // 调用顺序：middleware->bind
 }
 
-var defaultCmdSet = &CmdSet{
-	e: make(map[string]*cmdEntry),
+// 启动时拒绝无效的注册
+func newCmdEntry(name string, h Handler, i interface{}, isPushQueue bool) *cmdEntry {
+	type_ := reflect.TypeOf(i)
+	if type_ == nil || type_.Kind() != reflect.Ptr {
+		panic(fmt.Sprintf("cmd %s bind invalid args type %v", name, type_))
+	}
+	return &cmdEntry{h: h, type_: type_, rules: compileRules(type_), isPushQueue: isPushQueue}
 }
 
 func (s *CmdSet) Bind(name string, h Handler, i interface{}, isPushQueue bool) {
+	e := newCmdEntry(name, h, i, isPushQueue)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if _, ok := s.e[name]; ok {
-		log.Warnf("%s exist", name)
+	if old, ok := s.e[name]; ok {
+		panic(fmt.Sprintf("cmd %s is existed with args type %v", name, old.type_))
 	}
-	type_ := reflect.TypeOf(i)
-	s.e[name] = &cmdEntry{h: h, type_: type_, isPushQueue: isPushQueue}
+	e.chained = s.chain(name, e.h)
+	s.e[name] = e
 }
 
+// Deprecated: 使用Use，可注册多个
 func (s *CmdSet) Hook(h Handler) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.hook != nil {
-		log.Warn("cmd hook is existed")
-	}
-	s.hook = h
+	s.Use(hookMiddleware(h))
 }
 
 func (s *CmdSet) Handle(ctx *Context, msgId string, data []byte) error {
 	ctx.MsgId = msgId
+	ctx.node = s.node
+	recordIn(ctx, msgId, data)
 	// 空数据使用默认JSON格式数据
 	if len(data) == 0 {
 		data = []byte("{}")
@@ -179,39 +296,54 @@ func (s *CmdSet) Handle(ctx *Context, msgId string, data []byte) error {
 
 	serverName, name := routeMessage("", msgId)
 	s.mu.RLock()
-	e := s.e[name]
-	hook := s.hook
+	e := s.lookupLocked(name, ctx.Version)
+	var h Handler
+	if e != nil {
+		h = e.chained
+	}
 	s.mu.RUnlock()
 	// 转发消息
 	if len(serverName) > 0 {
-		if ss := GetSession(ctx.Ssid); ss != nil {
+		if ss := s.node.GetSession(ctx.Ssid); ss != nil {
+			start := time.Now()
 			ss.routeContext(ctx, name, data)
+			recordSpan(ctx, msgId, start)
 		}
 		return nil
 	}
 
+	// 收到的错误回复不再回复
 	if e == nil {
-		return errors.New("invalid message id")
+		if name != ErrorReplyId {
+			ctx.Error(CodeUnknownMessage, "unknown message "+name)
+		}
+		return errUnknownMessage
 	}
 
 	// unmarshal argument
 	args := reflect.New(e.type_.Elem()).Interface()
-	if err := json.Unmarshal(data, args); err != nil {
+	if err := unmarshalData(data, args); err != nil {
+		s.node.metrics.addError(name)
+		ctx.Error(CodeBadRequest, "invalid message data")
 		return err
 	}
+	// 校验参数
+	if e.rules != nil {
+		if err := e.rules.validate(reflect.ValueOf(args)); err != nil {
+			s.node.metrics.addInvalid(name)
+			ctx.Error(CodeBadRequest, err.Error())
+			return err
+		}
+	}
 
 	// 消息入队处理
+	msg := &Message{id: name, ctx: ctx, h: h, args: args}
 	if e.isPushQueue {
-		msg := &Message{id: name, ctx: ctx, h: e.h, args: args, hook: hook}
-		defaultMessageQueue.Enqueue(msg)
+		msg.enqueueTime = time.Now()
+		s.node.dispatch(msg)
 	} else {
 		// 消息直接处理。入网关转发数据时
-		if hook != nil {
-			hook(ctx, args)
-		}
-		if !ctx.isFail {
-			e.h(ctx, args)
-		}
+		s.node.runMessage(msg)
 	}
 
 	return nil
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestFragmentMessage(t *testing.T) {
+	r, w := net.Pipe()
+	defer r.Close()
+	defer w.Close()
+
+	samples := []int{1, maxFrameSize - 1, maxFrameSize, maxFrameSize + 1, 2 * maxFrameSize, 300 << 10}
+	go func() {
+		c := &TCPConn{rwc: w}
+		for _, n := range samples {
+			data := make([]byte, n)
+			rand.Read(data)
+			if _, err := c.writeMsg(RawMessage, data); err != nil {
+				t.Error(err)
+			}
+			c.writeMsg(PingMessage, nil)
+		}
+	}()
+
+	c := &TCPConn{rwc: r}
+	for _, n := range samples {
+		mt, buf, err := c.ReadMessage()
+		if err != nil || mt != RawMessage || len(buf) != n {
+			t.Fatalf("read %d bytes message: type %d, len %d, %v", n, mt, len(buf), err)
+		}
+		if mt, _, _ := c.ReadMessage(); mt != PingMessage {
+			t.Fatalf("read message type %d after fragments", mt)
+		}
+	}
+}
+
+func TestTooLargeMessage(t *testing.T) {
+	c := newTCPConn("", nil)
+	if err := c.Write(make([]byte, maxMessageSize+1)); err != errTooLargeMessage {
+		t.Error("write too large message", err)
+	}
+	if _, err := c.NewMessageBytes(RawMessage, make([]byte, maxMessageSize+1)); err != errTooLargeMessage {
+		t.Error("new too large message", err)
+	}
+
+	buf, _ := c.NewMessageBytes(RawMessage, bytes.Repeat([]byte{1}, maxFrameSize+1))
+	if len(buf) != maxFrameSize+1+2*messageHeadSize || buf[0] != FragmentMessage {
+		t.Error("invalid fragment message bytes")
+	}
+}
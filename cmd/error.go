@@ -0,0 +1,63 @@
+package cmd
+
+// 2021-09-30 错误回复。处理函数通过Context.Error回复错误
+// 未知消息、解析失败及处理异常时自动回复，同步请求返回*Error
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 错误回复的消息ID，收到该消息时不再回复
+const ErrorReplyId = "ServerError"
+
+const (
+	CodeBadRequest     = 400 // 解析失败
+	CodeUnknownMessage = 404 // 未知消息
+	CodeInternal       = 500 // 处理异常
+	CodeUnavailable    = 503 // 服务不可用
+)
+
+var (
+	errUnknownMessage = errors.New("invalid message id")
+)
+
+type Error struct {
+	Code int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("error %d: %s", e.Code, e.Msg)
+}
+
+// 网关等不支持Package的连接通过数据获取错误
+type errorArgs struct {
+	MsgId string
+	Code  int
+	Err   string
+}
+
+// 回复错误，后续的中间件及处理函数不再调用
+func (ctx *Context) Error(code int, msg string) error {
+	ctx.Fail()
+	if ctx.Out == nil {
+		return nil
+	}
+
+	body := errorArgs{MsgId: ctx.MsgId, Code: code, Err: msg}
+	if c, ok := ctx.Out.(packageWriter); ok {
+		// 经网关转发的消息，回复到发送消息的客户端
+		pkg := &Package{Id: ErrorReplyId, Body: body, Ssid: ctx.Ssid, ReqId: ctx.ReqId, Code: code, Err: msg}
+		return c.WritePackage(ctx.traceTo(pkg))
+	}
+	return ctx.Out.WriteJSON(ErrorReplyId, body)
+}
+
+// 回复的错误
+func packageError(pkg *Package) error {
+	if pkg.Code == 0 {
+		return nil
+	}
+	return &Error{Code: pkg.Code, Msg: pkg.Err}
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestErrorReply(t *testing.T) {
+	node := NewNode()
+	NodeOnWithoutQueue(node, "TestErrorArgs", func(ctx *Context, args *testCodecArgs) {})
+
+	rc := NewRecordConn()
+	if err := node.Handle(&Context{Out: rc, ReqId: 3, Ssid: "ssid"}, "TestErrorUnknown", nil); err == nil {
+		t.Error("handle unknown message")
+	}
+	node.Handle(&Context{Out: rc}, "TestErrorArgs", []byte(`{"N":"x"}`))
+	// 收到错误回复不再回复
+	node.Handle(&Context{Out: rc}, ErrorReplyId, nil)
+
+	pkgs := rc.Packages()
+	if len(pkgs) != 2 {
+		t.Fatal("error replies", pkgs)
+	}
+	if pkgs[0].Id != ErrorReplyId || pkgs[0].Code != CodeUnknownMessage || pkgs[0].ReqId != 3 || pkgs[0].Ssid != "ssid" {
+		t.Error("unknown message reply", pkgs[0])
+	}
+	args := &errorArgs{}
+	if _, err := rc.Last(args); err != nil || args.Code != CodeBadRequest || args.MsgId != "TestErrorArgs" {
+		t.Error("bad request reply", args, err)
+	}
+}
+
+func TestCallError(t *testing.T) {
+	server, client := NewNode(), NewNode()
+	srv := &Server{Addr: "mem://test_call_error", Node: server}
+	go srv.ListenAndServe()
+	defer srv.Shutdown(context.Background())
+	client.SetRouterAddr("mem://test_call_error")
+
+	NodeOnWithoutQueue(server, "TestCallError", func(ctx *Context, args *testCodecArgs) {
+		ctx.Error(CodeUnavailable, "busy")
+		ctx.WriteJSON("TestCallError", args)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := client.Call(ctx, "router", "TestCallError", &testCodecArgs{}, &testCodecArgs{})
+	var e *Error
+	if !errors.As(err, &e) || e.Code != CodeUnavailable || e.Msg != "busy" {
+		t.Error("call error", err)
+	}
+}
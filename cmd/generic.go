@@ -0,0 +1,27 @@
+package cmd
+
+// 2021-09-02 泛型注册消息，由处理函数推导参数类型，无需类型断言
+
+// 注册消息，消息入队处理
+func On[T any](name string, h func(*Context, *T)) {
+	NodeOn(DefaultNode(), name, h)
+}
+
+// 注册消息，消息不入队列直接处理
+func OnWithoutQueue[T any](name string, h func(*Context, *T)) {
+	NodeOnWithoutQueue(DefaultNode(), name, h)
+}
+
+func NodeOn[T any](node *Node, name string, h func(*Context, *T)) {
+	node.cmdSet.Bind(name, typedHandler(h), (*T)(nil), true)
+}
+
+func NodeOnWithoutQueue[T any](node *Node, name string, h func(*Context, *T)) {
+	node.cmdSet.Bind(name, typedHandler(h), (*T)(nil), false)
+}
+
+func typedHandler[T any](h func(*Context, *T)) Handler {
+	return func(ctx *Context, args interface{}) {
+		h(ctx, args.(*T))
+	}
+}
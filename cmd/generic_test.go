@@ -0,0 +1,33 @@
+package cmd
+
+import "testing"
+
+func TestOn(t *testing.T) {
+	node := NewNode()
+	var n int
+	NodeOn(node, "TestOn", func(ctx *Context, args *testCodecArgs) { n += args.N })
+	NodeOnWithoutQueue(node, "TestOnWithoutQueue", func(ctx *Context, args *testCodecArgs) { n += args.N })
+
+	node.Handle(&Context{}, "TestOn", []byte(`{"N":1}`))
+	node.Handle(&Context{}, "TestOnWithoutQueue", []byte(`{"N":2}`))
+	node.waitAndRunOnce(8, 0)
+	if n != 3 {
+		t.Error("handle typed message", n)
+	}
+
+	for _, bind := range []func(){
+		func() { NodeOn(node, "TestOn", func(ctx *Context, args *testCodecArgs) {}) },
+		func() { NodeOn(node, "TestOn", func(ctx *Context, args *testShardArgs) {}) },
+		func() { node.BindWithName("TestOn", func(*Context, interface{}) {}, (*testCodecArgs)(nil)) },
+		func() { node.BindWithName("TestBindInvalid", func(*Context, interface{}) {}, testCodecArgs{}) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("bind duplicate or invalid message")
+				}
+			}()
+			bind()
+		}()
+	}
+}
@@ -0,0 +1,185 @@
+package cmd
+
+// 2021-09-14 进程内的连接，不占用端口，用于测试
+// 地址格式mem://name，同一进程内可启动网关、router及服务，各自使用单独的节点
+// 网关通过gateway.Bind及gateway.NewHandler、router通过router.Bind指定节点
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+const memScheme = "mem://"
+
+var (
+	memListeners   = map[string]*memListener{}
+	memListenersMu sync.Mutex
+
+	errMemAddrInUse   = errors.New("mem address already in use")
+	errMemConnRefused = errors.New("mem connection refused")
+)
+
+func isMemAddr(addr string) bool {
+	return strings.HasPrefix(addr, memScheme)
+}
+
+type memAddr string
+
+func (addr memAddr) Network() string {
+	return "mem"
+}
+
+func (addr memAddr) String() string {
+	return string(addr)
+}
+
+type memListener struct {
+	addr  memAddr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// 进程内监听，地址格式mem://name
+func ListenMem(addr string) (net.Listener, error) {
+	memListenersMu.Lock()
+	defer memListenersMu.Unlock()
+	if _, ok := memListeners[addr]; ok {
+		return nil, errMemAddrInUse
+	}
+	l := &memListener{
+		addr:  memAddr(addr),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	memListeners[addr] = l
+	return l, nil
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		memListenersMu.Lock()
+		delete(memListeners, string(l.addr))
+		memListenersMu.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+func dialMem(addr string) (net.Conn, error) {
+	memListenersMu.Lock()
+	l := memListeners[addr]
+	memListenersMu.Unlock()
+	if l == nil {
+		return nil, errMemConnRefused
+	}
+
+	c1, c2 := net.Pipe()
+	select {
+	case l.conns <- c2:
+		return c1, nil
+	case <-l.done:
+		c1.Close()
+		c2.Close()
+		return nil, errMemConnRefused
+	}
+}
+
+// 记录发送的消息，用于测试断言
+type RecordConn struct {
+	mu       sync.Mutex
+	packages []*Package
+	isClosed bool
+}
+
+func NewRecordConn() *RecordConn {
+	return &RecordConn{}
+}
+
+func (c *RecordConn) record(pkg *Package) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.packages = append(c.packages, pkg)
+}
+
+func (c *RecordConn) Write(buf []byte) error {
+	pkg, err := defaultRawParser.Decode(buf)
+	if err != nil {
+		return err
+	}
+	c.record(pkg)
+	return nil
+}
+
+func (c *RecordConn) WriteJSON(name string, i interface{}) error {
+	return c.WritePackage(&Package{Id: name, Body: i})
+}
+
+func (c *RecordConn) WritePackage(pkg *Package) error {
+	data, err := marshalJSON(pkg.Body)
+	if err != nil {
+		return err
+	}
+	pkg2 := *pkg
+	pkg2.Data, pkg2.Body = data, nil
+	c.record(&pkg2)
+	return nil
+}
+
+func (c *RecordConn) RemoteAddr() string {
+	return "record"
+}
+
+func (c *RecordConn) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.isClosed = true
+}
+
+func (c *RecordConn) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.isClosed
+}
+
+// 已发送的消息
+func (c *RecordConn) Packages() []*Package {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Package(nil), c.packages...)
+}
+
+// 发送的最后一个消息，i不为空时解析数据
+func (c *RecordConn) Last(i interface{}) (*Package, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.packages) == 0 {
+		return nil, errors.New("no package")
+	}
+	pkg := c.packages[len(c.packages)-1]
+	if i != nil {
+		return pkg, unmarshalData(pkg.Data, i)
+	}
+	return pkg, nil
+}
+
+func (c *RecordConn) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.packages = nil
+}
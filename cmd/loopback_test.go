@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLoopbackCluster(t *testing.T) {
+	router, hall, client := NewNode(), NewNode(), NewNode()
+	for _, srv := range []*Server{
+		{Addr: "mem://test_router", Node: router},
+		{Addr: "mem://test_hall", Node: hall},
+	} {
+		go srv.ListenAndServe()
+		defer srv.Shutdown(context.Background())
+	}
+	client.SetRouterAddr("mem://test_router")
+
+	NodeOnWithoutQueue(router, "C2S_GetServerAddr", func(ctx *Context, args *cmdArgs) {
+		ctx.WriteJSON("S2C_GetServerAddr", cmdArgs{ServerAddr: "mem://test_" + args.ServerName})
+	})
+	NodeOnWithoutQueue(hall, "TestEcho", func(ctx *Context, args *testCodecArgs) {
+		ctx.WriteJSON("TestEcho", args)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	out := &testCodecArgs{}
+	if err := client.Call(ctx, "hall", "TestEcho", &testCodecArgs{N: 3, S: "mem"}, out); err != nil {
+		t.Fatal(err)
+	}
+	if *out != (testCodecArgs{N: 3, S: "mem"}) {
+		t.Error("invalid echo", out)
+	}
+	if _, err := ListenMem("mem://test_hall"); err != errMemAddrInUse {
+		t.Error("listen used mem address", err)
+	}
+	if _, err := dialMem("mem://test_none"); err != errMemConnRefused {
+		t.Error("dial unknown mem address", err)
+	}
+}
+
+func TestRecordConn(t *testing.T) {
+	node := NewNode()
+	NodeOnWithoutQueue(node, "TestRecord", func(ctx *Context, args *testCodecArgs) {
+		args.N++
+		ctx.WriteJSON("TestRecordOk", args)
+		(&Session{Id: ctx.Ssid, Out: ctx.Out}).WriteJSON("TestRecordSession", args)
+	})
+
+	rc := NewRecordConn()
+	node.Handle(&Context{Out: rc, Ssid: "abc", ReqId: 7}, "TestRecord", []byte(`{"N":1}`))
+	pkgs := rc.Packages()
+	if len(pkgs) != 2 || pkgs[0].Id != "TestRecordOk" || pkgs[0].ReqId != 7 || pkgs[1].Ssid != "abc" {
+		t.Fatal("record packages", pkgs)
+	}
+	args := &testCodecArgs{}
+	if _, err := rc.Last(args); err != nil || args.N != 2 {
+		t.Error("last package", args, err)
+	}
+}
@@ -4,17 +4,16 @@ import (
 	"bytes"
 	"compress/zlib"
 	"crypto/md5"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
-	"sort"
 	"strings"
 	"time"
 
 	"github.com/buger/jsonparser"
-	"github.com/guogeer/quasar/log"
 )
 
 var (
@@ -24,26 +23,48 @@ var (
 )
 
 type Context struct {
-	Out         Conn   // 连接
-	MsgId       string // 消息ID
-	Ssid        string // 发送方会话ID
-	Version     int    // 协议版本，当前未生效
-	ServerName  string // 请求的协议头
-	ClientAddr  string // 客户端地址
-	MatchServer string // 多个服务合并后的唯一serverName
-	isFail      bool   // 失败处理后，不需要继续处理
+	Out          Conn   // 连接
+	MsgId        string // 消息ID
+	Ssid         string // 发送方会话ID
+	Version      int    // 协议版本，网关握手时协商
+	ServerName   string // 请求的协议头
+	ClientAddr   string // 客户端地址
+	MatchServer  string // 多个服务合并后的唯一serverName
+	ReqId        uint64 // 同步请求ID
+	TraceId      string // 链路ID，未开启追踪时为空
+	SpanId       string // 当前处理的SpanId
+	ParentSpanId string // 上一跳的SpanId
+	isFail       bool   // 失败处理后，不需要继续处理
+	node         *Node
+}
+
+// 处理消息的节点
+func (ctx *Context) Node() *Node {
+	if ctx.node == nil {
+		return DefaultNode()
+	}
+	return ctx.node
 }
 
 func (ctx *Context) Fail() {
 	ctx.isFail = true
 }
 
+// 回复消息。同步请求Call时携带请求ID，追踪时携带链路ID
+func (ctx *Context) WriteJSON(name string, i interface{}) error {
+	if c, ok := ctx.Out.(packageWriter); ok && (ctx.ReqId != 0 || ctx.TraceId != "") {
+		return c.WritePackage(ctx.traceTo(&Package{Id: name, Body: i, ReqId: ctx.ReqId}))
+	}
+	return ctx.Out.WriteJSON(name, i)
+}
+
 type Message struct {
 	id   string
 	h    Handler
-	hook Handler
 	ctx  *Context
 	args interface{}
+
+	enqueueTime time.Time // 统计排队耗时，直接处理时为空
 }
 
 type SafeQueue struct {
@@ -83,110 +104,6 @@ func (h *SafeQueue) Dequeue(delay time.Duration) interface{} {
 	return nil
 }
 
-var defaultMessageQueue = NewSafeQueue(16 << 10)
-
-func GetMessageQueue() *SafeQueue {
-	return defaultMessageQueue
-}
-
-// 统计消息平均负载&访问频率等
-type messageStat struct {
-	id   string
-	d    time.Duration // 耗时
-	call int           // 调用次数
-}
-
-func (stat *messageStat) merge(stat2 *messageStat) {
-	if stat2 != nil {
-		stat.d += stat2.d
-		stat.call += stat2.call
-	}
-}
-
-var (
-	lastPrintTime time.Time // 10分钟打印一次
-	messageStats  map[string]messageStat
-)
-
-// TODO 暂时未考虑并发访问
-func waitAndRunOnce(loop int, delay time.Duration) {
-	var t1, t2 time.Time
-	var stats map[string]messageStat
-	if enableDebug {
-		stats = map[string]messageStat{}
-	}
-	for i := 0; i < loop; i++ {
-		front := GetMessageQueue().Dequeue(delay)
-		if front == nil {
-			break
-		}
-		if enableDebug {
-			t1 = time.Now()
-		}
-		msg := front.(*Message)
-		if msg.hook != nil {
-			msg.hook(msg.ctx, msg.args)
-		}
-		if !msg.ctx.isFail {
-			msg.h(msg.ctx, msg.args)
-		}
-
-		if enableDebug {
-			t2 = time.Now()
-			stat := stats[msg.id]
-			stat.merge(&messageStat{d: t2.Sub(t1), call: 1})
-			stats[msg.id] = stat
-		}
-	}
-	if enableDebug {
-		if lastPrintTime.IsZero() {
-			lastPrintTime = time.Now()
-		}
-		if len(messageStats) == 0 {
-			messageStats = map[string]messageStat{}
-		}
-
-		for id, stat := range stats {
-			stat2 := messageStats[id]
-			stat2.merge(&stat)
-			messageStats[id] = stat2
-		}
-		tpc := make([]messageStat, 0, 256) // cost time per call
-		cps := make([]messageStat, 0, 256) // call per second
-		for id, stat := range messageStats {
-			stat.id = id
-			tpc = append(tpc, stat)
-			cps = append(cps, stat)
-		}
-
-		d := time.Since(lastPrintTime)
-		if d >= 10*time.Minute {
-			log.Debug("=========== message stats start  ============")
-			sort.SliceStable(tpc, func(i, j int) bool {
-				return tpc[i].d.Seconds()/float64(tpc[i].call) > tpc[j].d.Seconds()/float64(tpc[j].call)
-			})
-			sort.SliceStable(cps, func(i, j int) bool { return cps[i].call > cps[j].call })
-			for i := 0; i < 10 && i < len(messageStats); i++ {
-				stat1, stat2 := tpc[i], cps[i]
-				log.Debugf("cost time per call: %s %.2fms, call per second %s %.2f", stat1.id, stat1.d.Seconds()*1000/float64(stat1.call), stat2.id, float64(stat2.call)/d.Seconds())
-			}
-			log.Debug("=========== message stats end  ============")
-
-			// 清理旧数据
-			messageStats = nil
-			lastPrintTime = time.Time{}
-		}
-	}
-}
-
-func RunOnce() {
-	waitAndRunOnce(256, 40*time.Millisecond)
-}
-
-func Enqueue(ctx *Context, h Handler, args interface{}) {
-	GetMessageQueue().Enqueue(&Message{ctx: ctx, h: h, args: args})
-}
-
 type Package struct {
 	Id         string          `json:",omitempty"`    // 消息ID
 	Data       json.RawMessage `json:",omitempty"`    // 数据,object类型
@@ -196,6 +113,13 @@ type Package struct {
 	ExpireTs   int64           `json:",omitempty"`    // 发送的时间戳
 	ServerName string          `json:",omitempty"`    // 请求的协议头
 	ClientAddr string          `json:",omitempty"`    // 客户端地址
+	ReqId      uint64          `json:",omitempty"`    // 同步请求ID，回复时原样返回
+	KeyId      string          `json:",omitempty"`    // HMAC签名的密钥ID
+	Nonce      string          `json:",omitempty"`    // 随机串，防重放
+	TraceId    string          `json:",omitempty"`    // 链路ID
+	SpanId     string          `json:",omitempty"`    // 发送方的SpanId
+	Code       int             `json:",omitempty"`    // 错误码，0表示成功
+	Err        string          `json:",omitempty"`    // 错误信息
 
 	Body     interface{} `json:"-"` // 传入的参数
 	IsZip    bool        `json:"-"`
@@ -246,10 +170,16 @@ type hashParser struct {
 	key             string
 	tempSign        string
 	compressPackage int // 压缩数据
+
+	hmacKeys  map[string][]byte // 有效的HMAC密钥，为空时使用md5
+	hmacKeyId string            // 签名使用的密钥
 }
 
 func (parser *hashParser) Encode(pkg *Package) ([]byte, error) {
 	pkg.Sign = parser.tempSign
+	if parser.hmacKeys != nil {
+		parser.prepareHMAC(pkg)
+	}
 	body, err := marshalJSON(pkg.Body)
 	if err != nil {
 		return nil, err
@@ -303,13 +233,16 @@ func (parser *hashParser) Decode(buf []byte) (*Package, error) {
 	if err != nil {
 		return pkg, ErrInvalidSign
 	}
-	if sign != "" && pkg.Sign != sign {
+	if sign != "" && subtle.ConstantTimeCompare([]byte(pkg.Sign), []byte(sign)) != 1 {
 		return pkg, ErrInvalidSign
 	}
 	return pkg, nil
 }
 
 func (parser *hashParser) Signature(data []byte) (string, error) {
+	if parser.hmacKeys != nil {
+		return parser.signatureHMAC(data)
+	}
 	ref, key := parser.ref, parser.key
 	if key == "" {
 		return "", nil
@@ -348,9 +281,13 @@ func Decode(buf []byte) (*Package, error) {
 	return defaultHashParser.Decode(buf)
 }
 
+// 二进制编码的数据转换为JSON
 func marshalJSON(i interface{}) ([]byte, error) {
 	switch v := i.(type) {
 	case []byte:
+		if isBinaryData(v) {
+			return binaryToJSON(v)
+		}
 		return v, nil
 	case string:
 		return []byte(v), nil
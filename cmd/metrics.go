@@ -0,0 +1,233 @@
+package cmd
+
+// 2021-09-06 统计各消息的调用次数、失败次数、排队及处理耗时
+// 支持接口读取与Prometheus文本格式输出
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 耗时分布的上界，最后一个桶为+Inf
+var histogramBuckets = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// 原子操作，处理消息时不加锁
+type histogram struct {
+	counts [11]int64 // len(histogramBuckets)+1
+	count  int64
+	sum    int64 // time.Duration
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(histogramBuckets), func(i int) bool { return d <= histogramBuckets[i] })
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// 按桶线性插值估算分位数，h为快照
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	var n int64
+	for i, c := range h.counts {
+		if c == 0 || float64(n+c) < rank {
+			n += c
+			continue
+		}
+		var lower time.Duration
+		if i > 0 {
+			lower = histogramBuckets[i-1]
+		}
+		if i == len(histogramBuckets) {
+			return lower
+		}
+		upper := histogramBuckets[i]
+		return lower + time.Duration(float64(upper-lower)*(rank-float64(n))/float64(c))
+	}
+	return histogramBuckets[len(histogramBuckets)-1]
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	// 读取时各字段可能不一致，总数按桶累加
+	var h2 histogram
+	for i := range h.counts {
+		h2.counts[i] = atomic.LoadInt64(&h.counts[i])
+		h2.count += h2.counts[i]
+	}
+	h2.sum = atomic.LoadInt64(&h.sum)
+
+	snap := HistogramSnapshot{
+		Count: h2.count,
+		Sum:   time.Duration(h2.sum),
+		P50:   h2.quantile(0.5),
+		P99:   h2.quantile(0.99),
+	}
+	snap.Buckets = make([]int64, len(h2.counts))
+	for i, c := range h2.counts {
+		snap.Buckets[i] = c
+		if i > 0 {
+			snap.Buckets[i] += snap.Buckets[i-1]
+		}
+	}
+	return snap
+}
+
+type HistogramSnapshot struct {
+	Count   int64
+	Sum     time.Duration
+	P50     time.Duration
+	P99     time.Duration
+	Buckets []int64 // 累计数量，对应histogramBuckets及+Inf
+}
+
+type MessageMetrics struct {
+	Id        string
+	Calls     int64 // 调用次数
+	Errors    int64 // 解析失败、处理失败或异常的次数
+	Invalid   int64 // 参数校验失败的次数
+	QueueWait HistogramSnapshot
+	Latency   HistogramSnapshot
+}
+
+type messageMetrics struct {
+	calls, errors, invalid int64 // 原子操作
+	wait, latency          histogram
+}
+
+type metricsRegistry struct {
+	messages sync.Map // 消息ID->*messageMetrics
+}
+
+func (r *metricsRegistry) get(id string) *messageMetrics {
+	if m, ok := r.messages.Load(id); ok {
+		return m.(*messageMetrics)
+	}
+	m, _ := r.messages.LoadOrStore(id, &messageMetrics{})
+	return m.(*messageMetrics)
+}
+
+func (r *metricsRegistry) observe(id string, wait, d time.Duration, isFail bool) {
+	m := r.get(id)
+	atomic.AddInt64(&m.calls, 1)
+	if isFail {
+		atomic.AddInt64(&m.errors, 1)
+	}
+	m.wait.observe(wait)
+	m.latency.observe(d)
+}
+
+func (r *metricsRegistry) addError(id string) {
+	atomic.AddInt64(&r.get(id).errors, 1)
+}
+
+func (r *metricsRegistry) addInvalid(id string) {
+	atomic.AddInt64(&r.get(id).invalid, 1)
+}
+
+// 按消息ID排序
+func (r *metricsRegistry) snapshot() []MessageMetrics {
+	var list []MessageMetrics
+	r.messages.Range(func(k, v interface{}) bool {
+		m := v.(*messageMetrics)
+		list = append(list, MessageMetrics{
+			Id:        k.(string),
+			Calls:     atomic.LoadInt64(&m.calls),
+			Errors:    atomic.LoadInt64(&m.errors),
+			Invalid:   atomic.LoadInt64(&m.invalid),
+			QueueWait: m.wait.snapshot(),
+			Latency:   m.latency.snapshot(),
+		})
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+func (node *Node) Metrics() []MessageMetrics {
+	return node.metrics.snapshot()
+}
+
+// Prometheus文本格式
+func (node *Node) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, node.Metrics())
+		writeBackpressureMetrics(w)
+	})
+}
+
+func Metrics() []MessageMetrics {
+	return DefaultNode().Metrics()
+}
+
+func MetricsHandler() http.Handler {
+	return DefaultNode().MetricsHandler()
+}
+
+func writeMetrics(w http.ResponseWriter, list []MessageMetrics) {
+	fmt.Fprintln(w, "# HELP quasar_message_calls_total Number of handled messages.")
+	fmt.Fprintln(w, "# TYPE quasar_message_calls_total counter")
+	for _, m := range list {
+		fmt.Fprintf(w, "quasar_message_calls_total{msg=%q} %d\n", m.Id, m.Calls)
+	}
+	fmt.Fprintln(w, "# HELP quasar_message_errors_total Number of failed messages.")
+	fmt.Fprintln(w, "# TYPE quasar_message_errors_total counter")
+	for _, m := range list {
+		fmt.Fprintf(w, "quasar_message_errors_total{msg=%q} %d\n", m.Id, m.Errors)
+	}
+	fmt.Fprintln(w, "# HELP quasar_message_invalid_total Number of messages rejected by validation.")
+	fmt.Fprintln(w, "# TYPE quasar_message_invalid_total counter")
+	for _, m := range list {
+		fmt.Fprintf(w, "quasar_message_invalid_total{msg=%q} %d\n", m.Id, m.Invalid)
+	}
+
+	histograms := []struct {
+		name, help string
+		get        func(*MessageMetrics) *HistogramSnapshot
+	}{
+		{"quasar_message_queue_wait_seconds", "Time messages wait in queue.", func(m *MessageMetrics) *HistogramSnapshot { return &m.QueueWait }},
+		{"quasar_message_latency_seconds", "Time spent handling messages.", func(m *MessageMetrics) *HistogramSnapshot { return &m.Latency }},
+	}
+	for _, h := range histograms {
+		fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+		fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+		for i := range list {
+			m := &list[i]
+			snap := h.get(m)
+			for k, n := range snap.Buckets {
+				le := "+Inf"
+				if k < len(histogramBuckets) {
+					le = fmt.Sprint(histogramBuckets[k].Seconds())
+				}
+				fmt.Fprintf(w, "%s_bucket{msg=%q,le=%q} %d\n", h.name, m.Id, le, n)
+			}
+			fmt.Fprintf(w, "%s_sum{msg=%q} %g\n", h.name, m.Id, snap.Sum.Seconds())
+			fmt.Fprintf(w, "%s_count{msg=%q} %d\n", h.name, m.Id, snap.Count)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP quasar_message_latency_quantile_seconds Estimated handling time quantiles.")
+	fmt.Fprintln(w, "# TYPE quasar_message_latency_quantile_seconds gauge")
+	for _, m := range list {
+		fmt.Fprintf(w, "quasar_message_latency_quantile_seconds{msg=%q,quantile=\"0.5\"} %g\n", m.Id, m.Latency.P50.Seconds())
+		fmt.Fprintf(w, "quasar_message_latency_quantile_seconds{msg=%q,quantile=\"0.99\"} %g\n", m.Id, m.Latency.P99.Seconds())
+	}
+}
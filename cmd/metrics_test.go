@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHistogramQuantile(t *testing.T) {
+	h := &histogram{}
+	for i := 0; i < 100; i++ {
+		h.observe(2 * time.Millisecond)
+	}
+	h.observe(2 * time.Second)
+	snap := h.snapshot()
+	if snap.P50 <= time.Millisecond || snap.P50 > 5*time.Millisecond {
+		t.Error("p50", snap.P50)
+	}
+	if snap.P99 > 5*time.Millisecond || snap.Buckets[len(snap.Buckets)-1] != 101 {
+		t.Error("p99", snap.P99, snap.Buckets)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	node := NewNode()
+	NodeOn(node, "TestMetrics", func(ctx *Context, args *testCodecArgs) {
+		if args.N < 0 {
+			ctx.Fail()
+		}
+	})
+	node.Handle(&Context{}, "TestMetrics", []byte(`{"N":1}`))
+	node.Handle(&Context{}, "TestMetrics", []byte(`{"N":-1}`))
+	node.Handle(&Context{}, "TestMetrics", []byte(`{"N":"x"}`))
+	node.waitAndRunOnce(8, 0)
+
+	list := node.Metrics()
+	if len(list) != 1 {
+		t.Fatal("metrics", list)
+	}
+	m := list[0]
+	if m.Id != "TestMetrics" || m.Calls != 2 || m.Errors != 2 || m.Latency.Count != 2 || m.QueueWait.Count != 2 {
+		t.Error("message metrics", m)
+	}
+
+	w := httptest.NewRecorder()
+	node.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`quasar_message_calls_total{msg="TestMetrics"} 2`,
+		`quasar_message_errors_total{msg="TestMetrics"} 2`,
+		`quasar_message_latency_seconds_bucket{msg="TestMetrics",le="+Inf"} 2`,
+		`quasar_message_queue_wait_seconds_count{msg="TestMetrics"} 2`,
+		`quasar_message_latency_quantile_seconds{msg="TestMetrics",quantile="0.99"}`,
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Error("metrics exposition miss", line)
+		}
+	}
+}
+
+func TestMetricsConcurrent(t *testing.T) {
+	r := &metricsRegistry{}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; k < 100; k++ {
+				r.observe("TestConcurrent", 0, time.Millisecond, k%2 == 0)
+				r.snapshot()
+			}
+		}()
+	}
+	wg.Wait()
+	list := r.snapshot()
+	if len(list) != 1 || list[0].Calls != 800 || list[0].Errors != 400 || list[0].Latency.Count != 800 {
+		t.Error("concurrent metrics", list)
+	}
+}
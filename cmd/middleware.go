@@ -0,0 +1,72 @@
+package cmd
+
+// 2021-08-24 中间件按注册顺序嵌套调用，next之前为前置处理，之后为后置处理
+// 中间件调用Context.Fail后，内层的中间件及消息处理函数不再调用
+
+import "strings"
+
+type Middleware func(next Handler) Handler
+
+type prefixMiddleware struct {
+	prefix string // 为空时匹配全部消息
+	mw     Middleware
+}
+
+// 兼容Hook：先调用h，未失败时继续处理
+func hookMiddleware(h Handler) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx *Context, args interface{}) {
+			h(ctx, args)
+			next(ctx, args)
+		}
+	}
+}
+
+// 失败后跳过内层调用
+func skipIfFail(h Handler) Handler {
+	return func(ctx *Context, args interface{}) {
+		if !ctx.isFail {
+			h(ctx, args)
+		}
+	}
+}
+
+func (ctx *Context) IsFail() bool {
+	return ctx.isFail
+}
+
+// 全部消息生效的中间件
+func (s *CmdSet) Use(mws ...Middleware) {
+	s.UseFor("", mws...)
+}
+
+// 消息ID匹配前缀时生效的中间件
+func (s *CmdSet) UseFor(prefix string, mws ...Middleware) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, mw := range mws {
+		s.middlewares = append(s.middlewares, prefixMiddleware{prefix: prefix, mw: mw})
+	}
+	// 已注册的消息重建调用链
+	for name, e := range s.e {
+		e.chained = s.chain(name, e.h)
+	}
+	for name, list := range s.versions {
+		for _, e := range list {
+			e.chained = s.chain(name, e.h)
+		}
+	}
+}
+
+// 需持有s.mu
+func (s *CmdSet) chain(name string, h Handler) Handler {
+	h = skipIfFail(h)
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		m := s.middlewares[i]
+		if strings.HasPrefix(name, m.prefix) {
+			h = skipIfFail(m.mw(h))
+		}
+	}
+	// 中间件异常同样恢复
+	return s.node.recoverHandler(name, h)
+}
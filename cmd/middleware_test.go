@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	node := NewNode()
+	var trace []string
+	logMiddleware := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx *Context, args interface{}) {
+				trace = append(trace, name+">")
+				next(ctx, args)
+				trace = append(trace, "<"+name)
+			}
+		}
+	}
+	node.Use(logMiddleware("a"), logMiddleware("b"))
+	node.UseFor("C2S_", logMiddleware("c2s"))
+	node.Hook(func(ctx *Context, args interface{}) {
+		if args.(*testCodecArgs).N < 0 {
+			ctx.Fail()
+		}
+	})
+	h := func(ctx *Context, args interface{}) { trace = append(trace, "h") }
+	node.BindWithName("C2S_Test", h, (*testCodecArgs)(nil))
+	node.BindWithoutQueue("S2C_Test", h, (*testCodecArgs)(nil))
+
+	samples := []struct {
+		id, data string
+		trace    []string
+	}{
+		{"C2S_Test", `{"N":1}`, []string{"a>", "b>", "c2s>", "h", "<c2s", "<b", "<a"}},
+		{"S2C_Test", `{"N":1}`, []string{"a>", "b>", "h", "<b", "<a"}},
+		{"S2C_Test", `{"N":-1}`, []string{"a>", "b>", "<b", "<a"}},
+	}
+	for _, sample := range samples {
+		trace = nil
+		if err := node.Handle(&Context{}, sample.id, []byte(sample.data)); err != nil {
+			t.Fatal(err)
+		}
+		node.waitAndRunOnce(8, 0)
+		if !reflect.DeepEqual(trace, sample.trace) {
+			t.Error("middleware trace", sample.id, trace)
+		}
+	}
+}
+
+func TestMiddlewareChainCache(t *testing.T) {
+	node := NewNode()
+	var builds, calls int
+	countMiddleware := func(next Handler) Handler {
+		builds++
+		return func(ctx *Context, args interface{}) {
+			calls++
+			next(ctx, args)
+		}
+	}
+	h := func(ctx *Context, args interface{}) {}
+	node.BindWithoutQueue("TestChain", h, (*testCodecArgs)(nil))
+	node.Use(countMiddleware)
+	n := builds
+	for i := 0; i < 3; i++ {
+		if err := node.Handle(&Context{}, "TestChain", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 调用链在Use时构建，处理消息时不再重建
+	if builds != n || calls != 3 {
+		t.Error("middleware chain", builds, calls)
+	}
+}
@@ -0,0 +1,1069 @@
+package cmd
+
+// 2026-10-18 二进制编码的消息体，格式兼容MessagePack
+// 结构体按字段名编码为map，字段名及omitempty与json标签一致，处理函数不感知编码
+// json.RawMessage及实现json.Marshaler的类型以扩展类型携带JSON数据
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 二进制消息体的首字节。MessagePack未使用该值，不会与JSON数据混淆
+const binaryDataMagic = 0xc1
+
+const extJSON = 1 // 扩展类型：JSON数据
+
+var (
+	errShortMsgpack   = errors.New("msgpack: unexpected end of data")
+	errInvalidMsgpack = errors.New("msgpack: invalid data")
+
+	rawMessageType      = reflect.TypeOf(json.RawMessage(nil))
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+	msgpackTypes  sync.Map // reflect.Type -> *msgpackType
+	msgpackTypeMu sync.Mutex
+	msgpackString = getMsgpackType(reflect.TypeOf(""))
+)
+
+// 消息数据是否为二进制编码
+func isBinaryData(data []byte) bool {
+	return len(data) > 0 && data[0] == binaryDataMagic
+}
+
+// 编码消息体，首字节为binaryDataMagic
+func marshalBinary(i interface{}) ([]byte, error) {
+	e := &msgpackEncoder{buf: make([]byte, 1, 256)}
+	e.buf[0] = binaryDataMagic
+	if err := e.encode(reflect.ValueOf(i)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+// 按编码格式解析消息数据
+func unmarshalData(data []byte, i interface{}) error {
+	if !isBinaryData(data) {
+		return json.Unmarshal(data, i)
+	}
+	v := reflect.ValueOf(i)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("msgpack: unmarshal non-pointer %v", reflect.TypeOf(i))
+	}
+	d := &msgpackDecoder{buf: data[1:]}
+	if err := d.decode(v.Elem(), getMsgpackType(v.Type().Elem())); err != nil {
+		return err
+	}
+	if d.off != len(d.buf) {
+		return errInvalidMsgpack
+	}
+	return nil
+}
+
+// 二进制数据转换为JSON，经JSON编码的连接转发时使用
+func binaryToJSON(data []byte) ([]byte, error) {
+	d := &msgpackDecoder{buf: data[1:], exact: true}
+	x, err := d.decodeAny()
+	if err != nil {
+		return nil, err
+	}
+	if d.off != len(d.buf) {
+		return nil, errInvalidMsgpack
+	}
+	return json.Marshal(x)
+}
+
+type msgpackField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+	typ       *msgpackType
+}
+
+// 类型信息首次使用时生成，编解码时不再检查类型
+type msgpackType struct {
+	typ  reflect.Type
+	kind reflect.Kind
+	zero reflect.Value
+
+	marshaler       bool // 实现json.Marshaler或encoding.TextMarshaler
+	ptrMarshaler    bool // 指针实现json.Marshaler或encoding.TextMarshaler
+	textMarshaler   bool // map的键使用
+	unmarshaler     bool // 指针实现json.Unmarshaler
+	textUnmarshaler bool
+
+	key, elem  *msgpackType // 指针、切片、数组及map的元素
+	fields     []msgpackField
+	fieldIndex map[string]int // 字段名匹配失败时忽略大小写，与json一致
+}
+
+func getMsgpackType(t reflect.Type) *msgpackType {
+	if v, ok := msgpackTypes.Load(t); ok {
+		return v.(*msgpackType)
+	}
+	msgpackTypeMu.Lock()
+	defer msgpackTypeMu.Unlock()
+	// 递归的类型生成完毕后再发布
+	building := map[reflect.Type]*msgpackType{}
+	mt := buildMsgpackType(t, building)
+	for t, mt := range building {
+		msgpackTypes.Store(t, mt)
+	}
+	return mt
+}
+
+// 需持有msgpackTypeMu
+func buildMsgpackType(t reflect.Type, building map[reflect.Type]*msgpackType) *msgpackType {
+	if v, ok := msgpackTypes.Load(t); ok {
+		return v.(*msgpackType)
+	}
+	if mt, ok := building[t]; ok {
+		return mt
+	}
+	mt := &msgpackType{typ: t, kind: t.Kind(), zero: reflect.Zero(t)}
+	building[t] = mt
+	// 仅命名类型及结构体可能实现编码接口
+	if t.Name() != "" && t.PkgPath() != "" || t.Kind() == reflect.Struct {
+		pt := reflect.PtrTo(t)
+		mt.marshaler = t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType)
+		mt.ptrMarshaler = pt.Implements(jsonMarshalerType) || pt.Implements(textMarshalerType)
+		mt.textMarshaler = t.Implements(textMarshalerType)
+		mt.unmarshaler = pt.Implements(jsonUnmarshalerType)
+		mt.textUnmarshaler = pt.Implements(textUnmarshalerType)
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		mt.elem = buildMsgpackType(t.Elem(), building)
+	case reflect.Map:
+		mt.key = buildMsgpackType(t.Key(), building)
+		mt.elem = buildMsgpackType(t.Elem(), building)
+	case reflect.Struct:
+		mt.fields = structFields(t)
+		mt.fieldIndex = make(map[string]int, len(mt.fields))
+		for i := range mt.fields {
+			f := &mt.fields[i]
+			f.typ = buildMsgpackType(t.FieldByIndex(f.index).Type, building)
+			mt.fieldIndex[f.name] = i
+		}
+	}
+	return mt
+}
+
+// 与encoding/json一致：匿名结构体字段展开，同名字段取层级最浅的
+func structFields(t reflect.Type) []msgpackField {
+	type field struct {
+		msgpackField
+		depth  int
+		tagged bool
+	}
+	var all []field
+	var walk func(t reflect.Type, index []int, depth int)
+	walk = func(t reflect.Type, index []int, depth int) {
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			tag := sf.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			idx := append(append([]int{}, index...), i)
+			if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+				// 未导出的嵌入指针无法分配
+				if !sf.IsExported() && sf.Type.Kind() == reflect.Ptr {
+					continue
+				}
+				walk(ft, idx, depth+1)
+				continue
+			}
+			if !sf.IsExported() {
+				continue
+			}
+			f := field{depth: depth, tagged: name != ""}
+			if name == "" {
+				name = sf.Name
+			}
+			f.name, f.index = name, idx
+			f.omitEmpty = strings.Contains(","+opts+",", ",omitempty,")
+			all = append(all, f)
+		}
+	}
+	walk(t, nil, 0)
+
+	var fields []msgpackField
+	for i, f := range all {
+		dominant := true
+		for j, other := range all {
+			if i == j || other.name != f.name {
+				continue
+			}
+			if other.depth < f.depth || (other.depth == f.depth && (other.tagged && !f.tagged || other.tagged == f.tagged)) {
+				dominant = false
+				break
+			}
+		}
+		if dominant {
+			fields = append(fields, f.msgpackField)
+		}
+	}
+	return fields
+}
+
+// 嵌入的空指针返回false
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	if len(index) == 1 {
+		return v.Field(index[0]), true
+	}
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// 嵌入的空指针分配内存
+func fieldByIndexAlloc(v reflect.Value, index []int) reflect.Value {
+	if len(index) == 1 {
+		return v.Field(index[0])
+	}
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, 0xc0)
+		return nil
+	}
+	return e.encodeType(v, getMsgpackType(v.Type()))
+}
+
+func (e *msgpackEncoder) encodeType(v reflect.Value, mt *msgpackType) error {
+	if mt.typ == rawMessageType {
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+		} else {
+			e.writeExt(extJSON, v.Bytes())
+		}
+		return nil
+	}
+	if mt.marshaler || (mt.ptrMarshaler && v.CanAddr()) {
+		if mt.kind == reflect.Ptr && v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		x := v.Interface()
+		if !mt.marshaler {
+			x = v.Addr().Interface()
+		}
+		b, err := json.Marshal(x)
+		if err != nil {
+			return err
+		}
+		e.writeExt(extJSON, b)
+		return nil
+	}
+
+	switch mt.kind {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeUint(v.Uint())
+	case reflect.Float32:
+		e.buf = append(e.buf, 0xca)
+		e.buf = appendUint32(e.buf, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.buf = append(e.buf, 0xcb)
+		e.buf = appendUint64(e.buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		e.writeString(v.String())
+	case reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Ptr:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		return e.encodeType(v.Elem(), mt.elem)
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		if mt.elem.kind == reflect.Uint8 {
+			e.writeBin(v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		n := v.Len()
+		e.writeHeader(n, 0x90, 0xdc, 0xdd)
+		for i := 0; i < n; i++ {
+			if err := e.encodeType(v.Index(i), mt.elem); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		e.writeHeader(v.Len(), 0x80, 0xde, 0xdf)
+		// 键值重复使用，避免每次复制分配内存
+		key := reflect.New(mt.key.typ).Elem()
+		elem := reflect.New(mt.elem.typ).Elem()
+		iter := v.MapRange()
+		for iter.Next() {
+			key.SetIterKey(iter)
+			elem.SetIterValue(iter)
+			if err := e.encodeKey(key, mt.key); err != nil {
+				return err
+			}
+			if err := e.encodeType(elem, mt.elem); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		n := 0
+		for _, f := range mt.fields {
+			if fv, ok := fieldByIndex(v, f.index); ok && !(f.omitEmpty && isEmptyValue(fv)) {
+				n++
+			}
+		}
+		e.writeHeader(n, 0x80, 0xde, 0xdf)
+		for _, f := range mt.fields {
+			fv, ok := fieldByIndex(v, f.index)
+			if !ok || (f.omitEmpty && isEmptyValue(fv)) {
+				continue
+			}
+			e.writeString(f.name)
+			if err := e.encodeType(fv, f.typ); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %v", mt.typ)
+	}
+	return nil
+}
+
+// 与json一致，键支持字符串、整数及encoding.TextMarshaler
+func (e *msgpackEncoder) encodeKey(k reflect.Value, mt *msgpackType) error {
+	if mt.kind == reflect.String {
+		e.writeString(k.String())
+		return nil
+	}
+	if mt.textMarshaler {
+		b, err := k.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		e.writeString(string(b))
+		return nil
+	}
+	switch mt.kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(k.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeUint(k.Uint())
+	default:
+		return fmt.Errorf("msgpack: unsupported map key type %v", mt.typ)
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) writeInt(x int64) {
+	switch {
+	case x >= 0:
+		e.writeUint(uint64(x))
+	case x >= -32:
+		e.buf = append(e.buf, byte(x))
+	case x >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(x))
+	case x >= math.MinInt16:
+		e.buf = append(e.buf, 0xd1)
+		e.buf = appendUint16(e.buf, uint16(x))
+	case x >= math.MinInt32:
+		e.buf = append(e.buf, 0xd2)
+		e.buf = appendUint32(e.buf, uint32(x))
+	default:
+		e.buf = append(e.buf, 0xd3)
+		e.buf = appendUint64(e.buf, uint64(x))
+	}
+}
+
+func (e *msgpackEncoder) writeUint(x uint64) {
+	switch {
+	case x <= 0x7f:
+		e.buf = append(e.buf, byte(x))
+	case x <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(x))
+	case x <= math.MaxUint16:
+		e.buf = append(e.buf, 0xcd)
+		e.buf = appendUint16(e.buf, uint16(x))
+	case x <= math.MaxUint32:
+		e.buf = append(e.buf, 0xce)
+		e.buf = appendUint32(e.buf, uint32(x))
+	default:
+		e.buf = append(e.buf, 0xcf)
+		e.buf = appendUint64(e.buf, x)
+	}
+}
+
+func (e *msgpackEncoder) writeString(s string) {
+	switch n := len(s); {
+	case n < 32:
+		e.buf = append(e.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xda)
+		e.buf = appendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xdb)
+		e.buf = appendUint32(e.buf, uint32(n))
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) writeBin(b []byte) {
+	switch n := len(b); {
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xc5)
+		e.buf = appendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xc6)
+		e.buf = appendUint32(e.buf, uint32(n))
+	}
+	e.buf = append(e.buf, b...)
+}
+
+func (e *msgpackEncoder) writeExt(typ byte, b []byte) {
+	switch n := len(b); {
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xc7, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xc8)
+		e.buf = appendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xc9)
+		e.buf = appendUint32(e.buf, uint32(n))
+	}
+	e.buf = append(e.buf, typ)
+	e.buf = append(e.buf, b...)
+}
+
+// 数组及map的头部
+func (e *msgpackEncoder) writeHeader(n int, fix, c16, c32 byte) {
+	switch {
+	case n < 16:
+		e.buf = append(e.buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, c16)
+		e.buf = appendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, c32)
+		e.buf = appendUint32(e.buf, uint32(n))
+	}
+}
+
+func appendUint16(buf []byte, x uint16) []byte {
+	return append(buf, byte(x>>8), byte(x))
+}
+
+func appendUint32(buf []byte, x uint32) []byte {
+	return append(buf, byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
+}
+
+func appendUint64(buf []byte, x uint64) []byte {
+	return append(buf, byte(x>>56), byte(x>>48), byte(x>>40), byte(x>>32),
+		byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
+}
+
+type msgpackDecoder struct {
+	buf   []byte
+	off   int
+	exact bool // 通用类型保留整数及JSON扩展数据，转换为JSON时使用
+}
+
+func (d *msgpackDecoder) peek() (byte, error) {
+	if d.off >= len(d.buf) {
+		return 0, errShortMsgpack
+	}
+	return d.buf[d.off], nil
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.buf)-d.off < n {
+		return nil, errShortMsgpack
+	}
+	b := d.buf[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) readByte() (byte, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *msgpackDecoder) readUintN(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var x uint64
+	for _, c := range b {
+		x = x<<8 | uint64(c)
+	}
+	return x, nil
+}
+
+func (d *msgpackDecoder) typeError(c byte, t reflect.Type) error {
+	return fmt.Errorf("msgpack: cannot unmarshal 0x%02x into %v", c, t)
+}
+
+// 数组及map的长度，每个元素至少占unit字节。ok为false时非该类型
+func (d *msgpackDecoder) readHeader(fix, c16, c32 byte, c byte, unit int) (n int, ok bool, err error) {
+	var x uint64
+	switch {
+	case c&0xf0 == fix:
+		d.off++
+		x = uint64(c & 0x0f)
+	case c == c16:
+		d.off++
+		x, err = d.readUintN(2)
+	case c == c32:
+		d.off++
+		x, err = d.readUintN(4)
+	default:
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, true, err
+	}
+	if x*uint64(unit) > uint64(len(d.buf)-d.off) {
+		return 0, true, errShortMsgpack
+	}
+	return int(x), true, nil
+}
+
+// 字符串、二进制及扩展数据，kind分别为s、b、e，ext为扩展类型。kind为0时非该类型
+func (d *msgpackDecoder) readRaw(c byte) (b []byte, kind byte, ext byte, err error) {
+	var n uint64
+	switch {
+	case c&0xe0 == 0xa0:
+		d.off++
+		n, kind = uint64(c&0x1f), 's'
+	case c == 0xd9, c == 0xda, c == 0xdb:
+		d.off++
+		n, err = d.readUintN(1 << (c - 0xd9))
+		kind = 's'
+	case c == 0xc4, c == 0xc5, c == 0xc6:
+		d.off++
+		n, err = d.readUintN(1 << (c - 0xc4))
+		kind = 'b'
+	case c == 0xc7, c == 0xc8, c == 0xc9:
+		d.off++
+		if n, err = d.readUintN(1 << (c - 0xc7)); err == nil {
+			ext, err = d.readByte()
+		}
+		kind = 'e'
+	case c >= 0xd4 && c <= 0xd8:
+		d.off++
+		n, kind = uint64(1)<<(c-0xd4), 'e'
+		ext, err = d.readByte()
+	default:
+		return nil, 0, 0, nil
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if n > uint64(len(d.buf)-d.off) {
+		return nil, 0, 0, errShortMsgpack
+	}
+	b, err = d.next(int(n))
+	return b, kind, ext, err
+}
+
+// 整数及浮点数，kind分别为i、u、f。kind为0时非数字
+func (d *msgpackDecoder) readNumber(c byte) (i int64, u uint64, f float64, kind byte, err error) {
+	switch {
+	case c <= 0x7f:
+		d.off++
+		return 0, uint64(c), 0, 'u', nil
+	case c >= 0xe0:
+		d.off++
+		return int64(int8(c)), 0, 0, 'i', nil
+	case c >= 0xcc && c <= 0xcf:
+		d.off++
+		u, err = d.readUintN(1 << (c - 0xcc))
+		return 0, u, 0, 'u', err
+	case c >= 0xd0 && c <= 0xd3:
+		d.off++
+		size := 1 << (c - 0xd0)
+		u, err = d.readUintN(size)
+		shift := 64 - 8*size
+		return int64(u<<shift) >> shift, 0, 0, 'i', err
+	case c == 0xca:
+		d.off++
+		u, err = d.readUintN(4)
+		return 0, 0, float64(math.Float32frombits(uint32(u))), 'f', err
+	case c == 0xcb:
+		d.off++
+		u, err = d.readUintN(8)
+		return 0, 0, math.Float64frombits(u), 'f', err
+	}
+	return 0, 0, 0, 0, nil
+}
+
+// 读取JSON数据，非扩展类型时转换为JSON
+func (d *msgpackDecoder) readJSON() ([]byte, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	off := d.off
+	if b, kind, ext, err := d.readRaw(c); err != nil {
+		return nil, err
+	} else if kind == 'e' && ext == extJSON {
+		return append([]byte(nil), b...), nil
+	}
+	d.off = off
+	exact := d.exact
+	d.exact = true
+	x, err := d.decodeAny()
+	d.exact = exact
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(x)
+}
+
+func (d *msgpackDecoder) decode(v reflect.Value, mt *msgpackType) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	// 与json一致，空值仅清空指针、接口、map及切片
+	if c == 0xc0 {
+		d.off++
+		switch mt.kind {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+			v.Set(mt.zero)
+		}
+		return nil
+	}
+	if mt.kind == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(mt.elem.typ))
+		}
+		return d.decode(v.Elem(), mt.elem)
+	}
+	if mt.typ == rawMessageType {
+		b, err := d.readJSON()
+		if err != nil {
+			return err
+		}
+		v.SetBytes(b)
+		return nil
+	}
+	if mt.unmarshaler && v.CanAddr() {
+		b, err := d.readJSON()
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(json.Unmarshaler).UnmarshalJSON(b)
+	}
+	if mt.textUnmarshaler && v.CanAddr() && (c&0xe0 == 0xa0 || c == 0xd9 || c == 0xda || c == 0xdb) {
+		b, _, _, err := d.readRaw(c)
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText(b)
+	}
+
+	switch mt.kind {
+	case reflect.Interface:
+		if v.NumMethod() > 0 {
+			return d.typeError(c, mt.typ)
+		}
+		x, err := d.decodeAny()
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			v.Set(mt.zero)
+		} else {
+			v.Set(reflect.ValueOf(x))
+		}
+	case reflect.Bool:
+		if c != 0xc2 && c != 0xc3 {
+			return d.typeError(c, mt.typ)
+		}
+		d.off++
+		v.SetBool(c == 0xc3)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, u, _, kind, err := d.readNumber(c)
+		if err != nil {
+			return err
+		}
+		if kind == 'u' {
+			if u > math.MaxInt64 {
+				return d.typeError(c, mt.typ)
+			}
+			i = int64(u)
+		} else if kind != 'i' {
+			return d.typeError(c, mt.typ)
+		}
+		if v.OverflowInt(i) {
+			return d.typeError(c, mt.typ)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		_, u, _, kind, err := d.readNumber(c)
+		if err != nil {
+			return err
+		}
+		if kind != 'u' || v.OverflowUint(u) {
+			return d.typeError(c, mt.typ)
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		i, u, f, kind, err := d.readNumber(c)
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case 'i':
+			f = float64(i)
+		case 'u':
+			f = float64(u)
+		case 0:
+			return d.typeError(c, mt.typ)
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		b, kind, _, err := d.readRaw(c)
+		if err != nil {
+			return err
+		}
+		if kind != 's' {
+			return d.typeError(c, mt.typ)
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		if mt.elem.kind == reflect.Uint8 {
+			b, kind, _, err := d.readRaw(c)
+			if err != nil {
+				return err
+			}
+			if kind != 'b' {
+				return d.typeError(c, mt.typ)
+			}
+			v.SetBytes(append([]byte{}, b...))
+			return nil
+		}
+		n, ok, err := d.readHeader(0x90, 0xdc, 0xdd, c, 1)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return d.typeError(c, mt.typ)
+		}
+		s := reflect.MakeSlice(mt.typ, n, n)
+		for i := 0; i < n; i++ {
+			if err := d.decode(s.Index(i), mt.elem); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Array:
+		n, ok, err := d.readHeader(0x90, 0xdc, 0xdd, c, 1)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return d.typeError(c, mt.typ)
+		}
+		for i := 0; i < n; i++ {
+			if i < v.Len() {
+				err = d.decode(v.Index(i), mt.elem)
+			} else {
+				_, err = d.decodeAny()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for i := n; i < v.Len(); i++ {
+			v.Index(i).Set(mt.elem.zero)
+		}
+	case reflect.Map:
+		n, ok, err := d.readHeader(0x80, 0xde, 0xdf, c, 2)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return d.typeError(c, mt.typ)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(mt.typ, n))
+		}
+		// 键值重复使用，写入map时复制
+		key := reflect.New(mt.key.typ).Elem()
+		elem := reflect.New(mt.elem.typ).Elem()
+		for i := 0; i < n; i++ {
+			if err := d.decodeKey(key, mt.key); err != nil {
+				return err
+			}
+			elem.Set(mt.elem.zero)
+			if err := d.decode(elem, mt.elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	case reflect.Struct:
+		n, ok, err := d.readHeader(0x80, 0xde, 0xdf, c, 2)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return d.typeError(c, mt.typ)
+		}
+		for i := 0; i < n; i++ {
+			c, err := d.peek()
+			if err != nil {
+				return err
+			}
+			b, kind, _, err := d.readRaw(c)
+			if err != nil {
+				return err
+			}
+			if kind != 's' {
+				return d.typeError(c, msgpackString.typ)
+			}
+			k, ok := mt.fieldIndex[string(b)]
+			if !ok {
+				k = -1
+				for j, f := range mt.fields {
+					if strings.EqualFold(f.name, string(b)) {
+						k = j
+						break
+					}
+				}
+			}
+			// 忽略未知的字段
+			if k < 0 {
+				if _, err := d.decodeAny(); err != nil {
+					return err
+				}
+				continue
+			}
+			f := &mt.fields[k]
+			if err := d.decode(fieldByIndexAlloc(v, f.index), f.typ); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %v", mt.typ)
+	}
+	return nil
+}
+
+// 字符串键可解析为整数，整数键可解析为字符串
+func (d *msgpackDecoder) decodeKey(k reflect.Value, mt *msgpackType) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	b, kind, _, err := d.readRaw(c)
+	if err != nil {
+		return err
+	}
+	if kind == 0 {
+		if mt.kind != reflect.String {
+			return d.decode(k, mt)
+		}
+		i, u, _, kind, err := d.readNumber(c)
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case 'i':
+			k.SetString(strconv.FormatInt(i, 10))
+		case 'u':
+			k.SetString(strconv.FormatUint(u, 10))
+		default:
+			return d.typeError(c, mt.typ)
+		}
+		return nil
+	}
+	if kind != 's' {
+		return d.typeError(c, mt.typ)
+	}
+	if mt.textUnmarshaler {
+		return k.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText(b)
+	}
+	switch mt.kind {
+	case reflect.String:
+		k.SetString(string(b))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(string(b), 10, 64)
+		if err != nil || k.OverflowInt(i) {
+			return d.typeError(c, mt.typ)
+		}
+		k.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := strconv.ParseUint(string(b), 10, 64)
+		if err != nil || k.OverflowUint(u) {
+			return d.typeError(c, mt.typ)
+		}
+		k.SetUint(u)
+	default:
+		return d.typeError(c, mt.typ)
+	}
+	return nil
+}
+
+// 与json解析到interface{}一致：数字为float64，map为map[string]interface{}
+func (d *msgpackDecoder) decodeAny() (interface{}, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch c {
+	case 0xc0:
+		d.off++
+		return nil, nil
+	case 0xc2, 0xc3:
+		d.off++
+		return c == 0xc3, nil
+	}
+	if i, u, f, kind, err := d.readNumber(c); err != nil {
+		return nil, err
+	} else if kind != 0 {
+		switch {
+		case kind == 'f':
+			return f, nil
+		case d.exact && kind == 'i':
+			return i, nil
+		case d.exact:
+			return u, nil
+		case kind == 'i':
+			return float64(i), nil
+		}
+		return float64(u), nil
+	}
+	if b, kind, ext, err := d.readRaw(c); err != nil {
+		return nil, err
+	} else if kind != 0 {
+		switch kind {
+		case 's':
+			return string(b), nil
+		case 'b':
+			// 与json一致，二进制数据为base64字符串
+			return base64.StdEncoding.EncodeToString(b), nil
+		}
+		if ext != extJSON {
+			return nil, errInvalidMsgpack
+		}
+		if d.exact {
+			return json.RawMessage(append([]byte(nil), b...)), nil
+		}
+		var x interface{}
+		err := json.Unmarshal(b, &x)
+		return x, err
+	}
+	if n, ok, err := d.readHeader(0x90, 0xdc, 0xdd, c, 1); err != nil {
+		return nil, err
+	} else if ok {
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = d.decodeAny(); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+	if n, ok, err := d.readHeader(0x80, 0xde, 0xdf, c, 2); err != nil {
+		return nil, err
+	} else if ok {
+		m := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			var k string
+			if err := d.decodeKey(reflect.ValueOf(&k).Elem(), msgpackString); err != nil {
+				return nil, err
+			}
+			if m[k], err = d.decodeAny(); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return nil, errInvalidMsgpack
+}
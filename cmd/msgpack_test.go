@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testMsgpackInner struct {
+	X, Y float64
+}
+
+type testMsgpackArgs struct {
+	testMsgpackInner
+	N      int               `json:"n"`
+	U      uint8             `json:",omitempty"`
+	Neg    int64             // 负数
+	Name   string            `json:"name,omitempty"`
+	Skip   string            `json:"-"`
+	Bytes  []byte            // 二进制
+	Items  []*testCodecArgs  // 指针切片
+	Scores map[int]string    // 整数键
+	Attrs  map[string]int64  // 字符串键
+	Raw    json.RawMessage   // 透传的JSON数据
+	Time   time.Time         // 实现json.Marshaler
+	Any    interface{}       // 与json一致解析为map及float64
+	Fixed  [2]int            // 数组
+	Nested *testMsgpackInner // 空指针
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	in := &testMsgpackArgs{
+		testMsgpackInner: testMsgpackInner{X: 1.5, Y: -2},
+		N:                300,
+		Neg:              -70000,
+		Skip:             "skip",
+		Bytes:            []byte{0, 1, 2},
+		Items:            []*testCodecArgs{{N: 1, S: "a"}, nil},
+		Scores:           map[int]string{-1: "lose", 1000: "win"},
+		Attrs:            map[string]int64{"hp": 1 << 40},
+		Raw:              json.RawMessage(`{"k":[1,2]}`),
+		Time:             time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC),
+		Any:              map[string]interface{}{"a": []interface{}{1, "b", nil, true}},
+		Fixed:            [2]int{7, 8},
+	}
+	data, err := marshalBinary(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isBinaryData(data) {
+		t.Fatal("binary data magic", data[0])
+	}
+	jsonData, _ := json.Marshal(in)
+
+	// 与JSON解析的结果一致
+	out, want := &testMsgpackArgs{}, &testMsgpackArgs{}
+	if err := unmarshalData(data, out); err != nil {
+		t.Fatal(err)
+	}
+	if err := unmarshalData(jsonData, want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("round trip\n%+v\n%+v", out, want)
+	}
+
+	var any1, any2 interface{}
+	if err := unmarshalData(data, &any1); err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal(jsonData, &any2)
+	if !reflect.DeepEqual(any1, any2) {
+		t.Errorf("decode interface\n%v\n%v", any1, any2)
+	}
+
+	// 经JSON编码的连接转发
+	converted, err := marshalJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var any3 interface{}
+	if err := json.Unmarshal(converted, &any3); err != nil || !reflect.DeepEqual(any3, any2) {
+		t.Errorf("convert to json %s %v", converted, err)
+	}
+}
+
+func TestMsgpackInvalid(t *testing.T) {
+	args := &testMsgpackArgs{}
+	samples := [][]byte{
+		{binaryDataMagic, 0x81, 0xa1, 'n'},              // 缺少值
+		{binaryDataMagic, 0x81, 0xa1, 'n', 0xa1, 'x'},   // 类型不匹配
+		{binaryDataMagic, 0x81, 0xa1, 'U', 0xcd, 1, 0},  // 溢出
+		{binaryDataMagic, 0xdf, 0xff, 0xff, 0xff, 0xff}, // 长度超出数据
+		{binaryDataMagic, 0x80, 0x80},                   // 多余的数据
+	}
+	for _, sample := range samples {
+		if err := unmarshalData(sample, args); err == nil {
+			t.Errorf("decode invalid data %v", sample)
+		}
+	}
+}
+
+// 场景同步的大消息
+type benchScene struct {
+	Frame   int
+	Players []benchPlayer
+}
+
+type benchPlayer struct {
+	UId    int
+	Name   string
+	X, Y   float64
+	HP     int
+	Skills []int
+	Buffs  map[string]int
+}
+
+func newBenchScene() *benchScene {
+	scene := &benchScene{Frame: 1024}
+	for i := 0; i < 100; i++ {
+		scene.Players = append(scene.Players, benchPlayer{
+			UId:    100000 + i,
+			Name:   "player",
+			X:      float64(i) * 1.25,
+			Y:      float64(i) * -0.5,
+			HP:     1000 - i,
+			Skills: []int{1, 2, 3, 4},
+			Buffs:  map[string]int{"speed": i, "shield": 2 * i},
+		})
+	}
+	return scene
+}
+
+func benchmarkCodec(b *testing.B, name string) {
+	codec := GetCodec(name)
+	scene := newBenchScene()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf, err := codec.Marshal(&Package{Id: "S2C_Scene", Body: scene})
+		if err != nil {
+			b.Fatal(err)
+		}
+		pkg, err := codec.Unmarshal(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := unmarshalData(pkg.Data, &benchScene{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCodecJSON(b *testing.B) {
+	benchmarkCodec(b, "json")
+}
+
+func BenchmarkCodecBinary(b *testing.B) {
+	benchmarkCodec(b, "binary")
+}
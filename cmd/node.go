@@ -0,0 +1,336 @@
+package cmd
+
+// 2021-08-20 服务节点独立持有消息集合、消息队列、会话与连接管理
+// 同一进程可运行多个节点，包级别的函数使用默认节点
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guogeer/quasar/log"
+)
+
+type Node struct {
+	cmdSet     *CmdSet
+	queue      *SafeQueue
+	sessions   *SessionManage
+	clients    *clientManage
+	routerAddr string // 为空时使用配置的路由地址
+
+	lastPrintTime time.Time // 10分钟打印一次
+	metrics       metricsRegistry
+	panics        panicStats
+
+	workerMu sync.RWMutex
+	workers  *workerPool // 为空时单线程处理
+}
+
+// 包级别函数使用的节点，首次使用时创建，其他文件的init可直接使用
+var (
+	defaultNode     *Node
+	defaultNodeOnce sync.Once
+)
+
+func NewNode() *Node {
+	node := &Node{
+		queue:    NewSafeQueue(16 << 10),
+		sessions: &SessionManage{sessions: make(map[string]*Session)},
+	}
+	node.cmdSet = &CmdSet{e: make(map[string]*cmdEntry), node: node}
+	node.clients = &clientManage{
+		pools:       make(map[string]*clientPool),
+		idleTimeout: defaultClientIdleTimeout,
+		buffer:      routeBuffer{ttl: defaultPendingTTL, size: defaultPendingSize, failures: defaultBreakerFailures},
+		node:        node,
+	}
+
+	// 断线后自动重连
+	node.BindWithName("C2S_RegisterOk", funcRegister, (*cmdArgs)(nil))
+	node.BindWithName("CMD_AutoConnect", funcAutoConnect, (*cmdArgs)(nil))
+	node.BindWithName("CMD_Close", funcClose, (*cmdArgs)(nil))
+	return node
+}
+
+func DefaultNode() *Node {
+	defaultNodeOnce.Do(func() { defaultNode = NewNode() })
+	return defaultNode
+}
+
+func (node *Node) SetRouterAddr(addr string) {
+	node.routerAddr = addr
+}
+
+func (node *Node) getRouterAddr() string {
+	if node.routerAddr != "" {
+		return node.routerAddr
+	}
+	return defaultRouterAddr
+}
+
+func (node *Node) CmdSet() *CmdSet {
+	return node.cmdSet
+}
+
+func (node *Node) BindWithName(name string, h Handler, args interface{}) {
+	node.cmdSet.Bind(name, h, args, true)
+}
+
+// 消息不入队列直接处理
+func (node *Node) BindWithoutQueue(name string, h Handler, args interface{}) {
+	node.cmdSet.Bind(name, h, args, false)
+}
+
+func (node *Node) Bind(h Handler, args interface{}) {
+	node.BindWithName(handlerName(h), h, args)
+}
+
+func (node *Node) Hook(h Handler) {
+	node.cmdSet.Hook(h)
+}
+
+func (node *Node) Use(mws ...Middleware) {
+	node.cmdSet.Use(mws...)
+}
+
+func (node *Node) UseFor(prefix string, mws ...Middleware) {
+	node.cmdSet.UseFor(prefix, mws...)
+}
+
+func (node *Node) Handle(ctx *Context, name string, data []byte) error {
+	return node.cmdSet.Handle(ctx, name, data)
+}
+
+// 服务不可用时返回错误
+func (node *Node) Route(serverName, messageId string, data interface{}) error {
+	return node.clients.Route3(serverName, messageId, data)
+}
+
+func (node *Node) RegisterService(config *ServiceConfig) {
+	node.clients.RegisterService(config)
+}
+
+func (node *Node) UnregisterService(ctx context.Context) error {
+	return node.clients.UnregisterService(ctx)
+}
+
+func (node *Node) Call(ctx context.Context, serverName, msgId string, in, out interface{}) error {
+	return node.clients.Call(ctx, serverName, msgId, in, out)
+}
+
+// 消息通过router转发。开启追踪时创建新的链路，处理消息时使用ctx.Forward透传
+func (node *Node) Forward(servers interface{}, messageId string, i interface{}) {
+	ctx := &Context{}
+	ctx.StartTrace()
+	node.forward(ctx, servers, messageId, i)
+}
+
+func (node *Node) forward(trace *Context, servers interface{}, messageId string, i interface{}) {
+	buf, err := marshalJSON(i)
+	if err != nil {
+		return
+	}
+
+	var serverList []string
+	switch v := servers.(type) {
+	case string:
+		serverList = []string{v}
+	case []string:
+		serverList = v
+	}
+	if len(serverList) == 0 {
+		return
+	}
+
+	args := &ForwardArgs{
+		ServerList: serverList,
+		Name:       messageId,
+		Data:       buf,
+	}
+	pkg := trace.traceTo(&Package{Id: "C2S_Route", Body: args})
+	node.clients.Route("router", pkg)
+}
+
+// 同步请求
+func (node *Node) Request(serverName, msgId string, in interface{}) ([]byte, error) {
+	var addr string
+	if serverName == "router" {
+		addr = node.getRouterAddr()
+	} else {
+		addr, _ = node.RequestServerAddr(serverName)
+	}
+	if addr == "" {
+		return nil, errInvalidAddr
+	}
+	rwc, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer rwc.Close()
+
+	c := &TCPConn{rwc: rwc}
+	// 第一个包发送校验数据
+	firstPackage, _ := defaultAuthParser.Encode(&Package{})
+	if _, err := c.writeMsg(AuthMessage, firstPackage); err != nil {
+		return nil, err
+	}
+	req := &Package{Id: msgId, Body: in}
+	buf, err := defaultRawParser.Encode(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.writeMsg(RawMessage, buf); err != nil {
+		return nil, err
+	}
+
+	// read message, ignore heart beat message
+	for i := 0; i < 8; i++ {
+		mt, buf, err := c.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if mt == RawMessage {
+			pkg, err := unmarshalPackage(buf)
+			if err != nil {
+				return nil, err
+			}
+			return pkg.Data, packageError(pkg)
+		}
+	}
+	return nil, errors.New("unkown error")
+}
+
+// 向路由请求服务器地址
+func (node *Node) RequestServerAddr(name string) (string, error) {
+	if name == "router" {
+		return node.getRouterAddr(), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+	defer cancel()
+
+	args := &cmdArgs{}
+	req := cmdArgs{ServerName: name}
+	if err := node.Call(ctx, "router", "C2S_GetServerAddr", req, args); err != nil {
+		return "", err
+	}
+	return args.ServerAddr, nil
+}
+
+func (node *Node) ListenAndServe(addr string) error {
+	srv := &Server{Addr: addr, Node: node}
+	return srv.ListenAndServe()
+}
+
+func (node *Node) GetMessageQueue() *SafeQueue {
+	return node.queue
+}
+
+// 入队的处理函数同样在异常时恢复
+func (node *Node) Enqueue(ctx *Context, h Handler, args interface{}) {
+	name := handlerName(h)
+	node.queue.Enqueue(&Message{id: name, ctx: ctx, h: node.recoverHandler(name, h), args: args, enqueueTime: time.Now()})
+}
+
+func (node *Node) GetSessionManage() *SessionManage {
+	return node.sessions
+}
+
+func (node *Node) AddSession(s *Session) {
+	s.node = node
+	node.sessions.Add(s)
+}
+
+func (node *Node) RemoveSession(id string) {
+	node.sessions.Del(id)
+}
+
+// 未加入会话管理的会话，如连接关闭后通知服务
+func (node *Node) NewSession(id string, out Conn) *Session {
+	return &Session{Id: id, Out: out, node: node}
+}
+
+func (node *Node) GetSession(id string) *Session {
+	return node.sessions.Get(id)
+}
+
+func (node *Node) GetSessionList() []*Session {
+	return node.sessions.GetList()
+}
+
+func (node *Node) RunOnce() {
+	node.waitAndRunOnce(256, 40*time.Millisecond)
+}
+
+// 处理队列中剩余的消息直到为空，退出前调用
+func (node *Node) Drain() {
+	for {
+		front := node.queue.Dequeue(0)
+		if front == nil {
+			return
+		}
+		node.runMessage(front.(*Message))
+	}
+}
+
+// TODO 暂时未考虑并发访问
+func (node *Node) waitAndRunOnce(loop int, delay time.Duration) {
+	for i := 0; i < loop; i++ {
+		front := node.queue.Dequeue(delay)
+		if front == nil {
+			break
+		}
+		node.runMessage(front.(*Message))
+	}
+	if enableDebug {
+		if node.lastPrintTime.IsZero() {
+			node.lastPrintTime = time.Now()
+		}
+		if d := time.Since(node.lastPrintTime); d >= 10*time.Minute {
+			node.printMetrics(d)
+			node.lastPrintTime = time.Now()
+		}
+	}
+}
+
+// 处理消息并统计排队、处理耗时
+func (node *Node) runMessage(msg *Message) {
+	start := time.Now()
+	var wait time.Duration
+	if !msg.enqueueTime.IsZero() {
+		wait = start.Sub(msg.enqueueTime)
+	}
+	msg.h(msg.ctx, msg.args)
+	node.metrics.observe(msg.id, wait, time.Since(start), msg.ctx.isFail)
+	recordSpan(msg.ctx, msg.id, start)
+}
+
+// 输出累计的消息统计
+func (node *Node) printMetrics(d time.Duration) {
+	tpc := node.Metrics()                        // cost time per call
+	cps := append([]MessageMetrics(nil), tpc...) // call per second
+	sort.SliceStable(tpc, func(i, j int) bool { return tpc[i].Latency.P99 > tpc[j].Latency.P99 })
+	sort.SliceStable(cps, func(i, j int) bool { return cps[i].Calls > cps[j].Calls })
+
+	log.Debug("=========== message stats start  ============")
+	for i := 0; i < 10 && i < len(tpc); i++ {
+		stat1, stat2 := tpc[i], cps[i]
+		log.Debugf("cost time p50 %s %v p99 %v, call %s %d errors %d", stat1.Id, stat1.Latency.P50, stat1.Latency.P99, stat2.Id, stat2.Calls, stat2.Errors)
+	}
+	log.Debug("=========== message stats end  ============")
+}
+
+// 函数名作为消息ID
+func handlerName(h Handler) string {
+	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+	n := strings.LastIndexByte(name, '.')
+	if n >= 0 {
+		name = name[n+1:]
+	}
+	return name
+}
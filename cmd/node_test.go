@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNodeIsolation(t *testing.T) {
+	n1, n2 := NewNode(), NewNode()
+	var calls [2]int
+	n1.BindWithName("TestNode", func(ctx *Context, data interface{}) { calls[0]++ }, (*testCodecArgs)(nil))
+	n2.BindWithName("TestNode", func(ctx *Context, data interface{}) { calls[1]++ }, (*testCodecArgs)(nil))
+
+	if err := n1.Handle(&Context{}, "TestNode", nil); err != nil {
+		t.Fatal(err)
+	}
+	n1.waitAndRunOnce(8, 0)
+	n2.waitAndRunOnce(8, 0)
+	if calls != [2]int{1, 0} {
+		t.Error("handle message in other node", calls)
+	}
+	if err := DefaultNode().Handle(&Context{}, "TestNode", nil); err == nil {
+		t.Error("handle message in default node")
+	}
+}
+
+func TestNodeDrain(t *testing.T) {
+	node := NewNode()
+	var calls int
+	node.BindWithName("TestDrain", func(ctx *Context, data interface{}) { calls++ }, (*testCodecArgs)(nil))
+	for i := 0; i < 300; i++ {
+		node.Handle(&Context{}, "TestDrain", nil)
+	}
+	node.waitAndRunOnce(256, 0)
+	node.Drain()
+	if calls != 300 {
+		t.Error("drain queue", calls)
+	}
+}
+
+func TestNodeCall(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := NewNode(), NewNode()
+	go (&Server{Node: server}).Serve(l)
+	client.SetRouterAddr(l.Addr().String())
+
+	server.BindWithoutQueue("TestNodeEcho", func(ctx *Context, data interface{}) {
+		if ctx.Node() != server {
+			t.Error("invalid context node")
+		}
+		ctx.WriteJSON("TestNodeEcho", data)
+	}, (*testCodecArgs)(nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	out := &testCodecArgs{}
+	if err := client.Call(ctx, "router", "TestNodeEcho", &testCodecArgs{N: 7}, out); err != nil || out.N != 7 {
+		t.Error("call other node", out, err)
+	}
+	if server.GetSessionManage().Count() != 1 || client.GetSessionManage().Count() != 0 {
+		t.Error("invalid node sessions")
+	}
+}
@@ -0,0 +1,132 @@
+package cmd
+
+// 2021-09-22 同一服务可建立多个连接，按会话哈希或轮询选择
+// 服务从路由消失且连接空闲一段时间后，删除连接不再重连
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+)
+
+type PoolSelect int
+
+const (
+	PoolHashSsid   PoolSelect = iota // 按会话哈希，同一会话的消息保持顺序。无会话时使用第一个连接
+	PoolRoundRobin                   // 轮询
+)
+
+var poolSelects = map[string]PoolSelect{
+	"hash":        PoolHashSsid,
+	"round_robin": PoolRoundRobin,
+}
+
+// 服务不存在时，空闲超过该时间的连接将删除
+const defaultClientIdleTimeout = time.Minute
+
+type poolConfig struct {
+	size    int
+	select_ PoolSelect
+}
+
+type clientPool struct {
+	name    string
+	clients []*Client
+	select_ PoolSelect
+	next    uint32
+
+	lastActive  int64 // 最近发送消息的时间，UnixNano
+	idleTimeout time.Duration
+	isClosed    int32
+}
+
+func newClientPool(cm *clientManage, name string, cfg poolConfig) *clientPool {
+	// 路由的连接需保持注册状态，仅使用一个连接
+	if cfg.size <= 0 || name == "router" {
+		cfg.size = 1
+	}
+	pool := &clientPool{
+		name:        name,
+		select_:     cfg.select_,
+		lastActive:  time.Now().UnixNano(),
+		idleTimeout: cm.idleTimeout,
+	}
+	for i := 0; i < cfg.size; i++ {
+		client := newClient(cm, name)
+		client.pool = pool
+		client.buffer = cm.buffer
+		pool.clients = append(pool.clients, client)
+	}
+	return pool
+}
+
+func (pool *clientPool) pick(ssid string) *Client {
+	atomic.StoreInt64(&pool.lastActive, time.Now().UnixNano())
+	n := uint32(len(pool.clients))
+	if n == 1 {
+		return pool.clients[0]
+	}
+	if pool.select_ == PoolRoundRobin {
+		return pool.clients[atomic.AddUint32(&pool.next, 1)%n]
+	}
+	// 无会话的消息保持顺序
+	if ssid == "" {
+		return pool.clients[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(ssid))
+	return pool.clients[h.Sum32()%n]
+}
+
+func (pool *clientPool) isIdle() bool {
+	last := atomic.LoadInt64(&pool.lastActive)
+	return time.Since(time.Unix(0, last)) > pool.idleTimeout
+}
+
+func (pool *clientPool) closed() bool {
+	return atomic.LoadInt32(&pool.isClosed) != 0
+}
+
+// 关闭发送队列，写协程退出后不再重连
+func (pool *clientPool) close() {
+	if atomic.CompareAndSwapInt32(&pool.isClosed, 0, 1) {
+		for _, client := range pool.clients {
+			client.send.Close()
+		}
+	}
+}
+
+// 设置连接池，需在连接前调用。serverName为空时设置默认值
+func (node *Node) SetClientPool(serverName string, size int, select_ PoolSelect) {
+	node.clients.setPoolConfig(serverName, poolConfig{size: size, select_: select_})
+}
+
+func (cm *clientManage) setPoolConfig(serverName string, cfg poolConfig) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.poolConfigs == nil {
+		cm.poolConfigs = map[string]poolConfig{}
+	}
+	cm.poolConfigs[serverName] = cfg
+}
+
+// 需持有cm.mu
+func (cm *clientManage) poolConfigLocked(serverName string) poolConfig {
+	if cfg, ok := cm.poolConfigs[serverName]; ok {
+		return cfg
+	}
+	return cm.poolConfigs[""]
+}
+
+// 服务已不存在，删除连接池
+func (cm *clientManage) removePool(pool *clientPool) {
+	cm.mu.Lock()
+	if cm.pools[pool.name] == pool {
+		delete(cm.pools, pool.name)
+	}
+	cm.mu.Unlock()
+	pool.close()
+	for _, client := range pool.clients {
+		client.closePending()
+	}
+}
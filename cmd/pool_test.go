@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientPool(t *testing.T) {
+	router, hall, client := NewNode(), NewNode(), NewNode()
+	client.clients.idleTimeout = 50 * time.Millisecond
+	routerSrv := &Server{Addr: "mem://test_pool_router", Node: router}
+	go routerSrv.ListenAndServe()
+	defer routerSrv.Shutdown(context.Background())
+	hallSrv := &Server{Addr: "mem://test_pool_hall", Node: hall}
+	go hallSrv.ListenAndServe()
+	client.SetRouterAddr("mem://test_pool_router")
+	client.SetClientPool("hall", 3, PoolHashSsid)
+
+	var hallAlive int32 = 1
+	NodeOnWithoutQueue(router, "C2S_GetServerAddr", func(ctx *Context, args *cmdArgs) {
+		var addr string
+		if atomic.LoadInt32(&hallAlive) == 1 {
+			addr = "mem://test_pool_hall"
+		}
+		ctx.WriteJSON("S2C_GetServerAddr", cmdArgs{ServerAddr: addr})
+	})
+
+	var mu sync.Mutex
+	seqs := map[string][]int{}
+	conns := map[Conn]bool{}
+	recv := make(chan bool, 64)
+	NodeOnWithoutQueue(hall, "TestPool", func(ctx *Context, args *testCodecArgs) {
+		mu.Lock()
+		seqs[ctx.Ssid] = append(seqs[ctx.Ssid], args.N)
+		conns[ctx.Out] = true
+		mu.Unlock()
+		recv <- true
+	})
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		for k := 0; k < 8; k++ {
+			ssid := fmt.Sprintf("ss%d", k)
+			client.clients.Route("hall", &Package{Id: "TestPool", Ssid: ssid, Body: &testCodecArgs{N: i}})
+		}
+	}
+	for i := 0; i < 8*n; i++ {
+		select {
+		case <-recv:
+		case <-time.After(3 * time.Second):
+			t.Fatal("wait pool message timeout")
+		}
+	}
+	mu.Lock()
+	for ssid, seq := range seqs {
+		for i := range seq {
+			if seq[i] != i {
+				t.Error("message out of order", ssid, seq)
+			}
+		}
+	}
+	if len(conns) < 2 {
+		t.Error("pool connections", len(conns))
+	}
+	mu.Unlock()
+
+	// 服务消失后，空闲的连接池删除
+	atomic.StoreInt32(&hallAlive, 0)
+	hallSrv.Shutdown(context.Background())
+	for i := 0; i < 100; i++ {
+		client.waitAndRunOnce(8, 10*time.Millisecond)
+		client.clients.mu.RLock()
+		_, ok := client.clients.pools["hall"]
+		client.clients.mu.RUnlock()
+		if !ok {
+			return
+		}
+	}
+	t.Error("idle pool not removed")
+}
+
+func TestClientPoolPickEmptySsid(t *testing.T) {
+	node := NewNode()
+	pool := newClientPool(node.clients, "hall", poolConfig{size: 3, select_: PoolHashSsid})
+	if pool.pick("") != pool.clients[0] {
+		t.Error("pick empty ssid")
+	}
+}
@@ -0,0 +1,123 @@
+package cmd
+
+// 2021-10-16 按主题发布订阅，经router转发
+// 主题以点分隔，订阅时*匹配一段，#匹配零或多段，如game.*.start、game.#
+// 订阅的主题保存在本地，与router重连后重新订阅
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// router在服务注册时发布S2C_AddGame，订阅时返回已注册的服务
+const TopicServerAdd = "router.server.add"
+
+var errInvalidTopic = errors.New("invalid topic")
+
+type SubscribeArgs struct {
+	Topics []string
+}
+
+type PublishArgs struct {
+	Topic string
+	Name  string
+	Data  json.RawMessage
+}
+
+// 订阅的主题是否匹配发布的主题
+func MatchTopic(pattern, topic string) bool {
+	return matchTopicSegments(strings.Split(pattern, "."), strings.Split(topic, "."))
+}
+
+func matchTopicSegments(pattern, topic []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "#" {
+			for i := 0; i <= len(topic); i++ {
+				if matchTopicSegments(pattern[1:], topic[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(topic) == 0 || (pattern[0] != "*" && pattern[0] != topic[0]) {
+			return false
+		}
+		pattern, topic = pattern[1:], topic[1:]
+	}
+	return len(topic) == 0
+}
+
+// 每段不为空，发布的主题不能包含通配符
+func checkTopic(topic string, isPattern bool) error {
+	for _, s := range strings.Split(topic, ".") {
+		if s == "" || (!isPattern && (s == "*" || s == "#")) {
+			return errInvalidTopic
+		}
+	}
+	return nil
+}
+
+func (cm *clientManage) subscribedTopics() []string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	topics := make([]string, 0, len(cm.topics))
+	for topic := range cm.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// 订阅主题，收到的消息按消息ID处理
+func (node *Node) Subscribe(topics ...string) error {
+	for _, topic := range topics {
+		if err := checkTopic(topic, true); err != nil {
+			return err
+		}
+	}
+
+	cm := node.clients
+	cm.mu.Lock()
+	if cm.topics == nil {
+		cm.topics = map[string]bool{}
+	}
+	for _, topic := range topics {
+		cm.topics[topic] = true
+	}
+	cm.mu.Unlock()
+	return cm.Route3("router", "C2S_Subscribe", SubscribeArgs{Topics: topics})
+}
+
+func (node *Node) Unsubscribe(topics ...string) error {
+	cm := node.clients
+	cm.mu.Lock()
+	for _, topic := range topics {
+		delete(cm.topics, topic)
+	}
+	cm.mu.Unlock()
+	return cm.Route3("router", "C2S_Unsubscribe", SubscribeArgs{Topics: topics})
+}
+
+// 发布消息到订阅该主题的服务
+func (node *Node) Publish(topic, messageId string, i interface{}) error {
+	if err := checkTopic(topic, false); err != nil {
+		return err
+	}
+	buf, err := marshalJSON(i)
+	if err != nil {
+		return err
+	}
+	return node.clients.Route3("router", "C2S_Publish", PublishArgs{Topic: topic, Name: messageId, Data: buf})
+}
+
+func Subscribe(topics ...string) error {
+	return DefaultNode().Subscribe(topics...)
+}
+
+func Unsubscribe(topics ...string) error {
+	return DefaultNode().Unsubscribe(topics...)
+}
+
+func Publish(topic, messageId string, i interface{}) error {
+	return DefaultNode().Publish(topic, messageId, i)
+}
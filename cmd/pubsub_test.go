@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMatchTopic(t *testing.T) {
+	for _, sample := range []struct {
+		pattern, topic string
+		match          bool
+	}{
+		{"game.start", "game.start", true},
+		{"game.*", "game.start", true},
+		{"game.*", "game.room.start", false},
+		{"game.*.start", "game.room.start", true},
+		{"game.#", "game", true},
+		{"game.#", "game.room.start", true},
+		{"#.start", "game.room.start", true},
+		{"game.#.end", "game.room.start", false},
+		{"#", "game.start", true},
+		{"game", "game.start", false},
+	} {
+		if MatchTopic(sample.pattern, sample.topic) != sample.match {
+			t.Errorf("match %s %s, expect %v", sample.pattern, sample.topic, sample.match)
+		}
+	}
+	if checkTopic("game..start", true) == nil || checkTopic("game.*", false) == nil || checkTopic("game.*", true) != nil {
+		t.Error("check topic")
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	router, hall := NewNode(), NewNode()
+	srv := &Server{Addr: "mem://test_pubsub_router", Node: router}
+	go srv.ListenAndServe()
+	defer srv.Shutdown(context.Background())
+	hall.SetRouterAddr("mem://test_pubsub_router")
+
+	subs := make(chan []string, 4)
+	pubs := make(chan *PublishArgs, 4)
+	NodeOnWithoutQueue(router, "C2S_Subscribe", func(ctx *Context, args *SubscribeArgs) {
+		subs <- args.Topics
+	})
+	NodeOnWithoutQueue(router, "C2S_Publish", func(ctx *Context, args *PublishArgs) {
+		pubs <- args
+	})
+
+	if err := hall.Subscribe("game.*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hall.Publish("game.*", "TestPubSub", nil); err != errInvalidTopic {
+		t.Error("publish wildcard topic", err)
+	}
+	if err := hall.Publish("game.start", "TestPubSub", &testCodecArgs{N: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(3 * time.Second)
+	select {
+	case topics := <-subs:
+		if len(topics) != 1 || topics[0] != "game.*" {
+			t.Error("subscribe topics", topics)
+		}
+	case <-timeout:
+		t.Fatal("wait subscribe timeout")
+	}
+	select {
+	case args := <-pubs:
+		if args.Topic != "game.start" || args.Name != "TestPubSub" || string(args.Data) != `{"N":1,"S":""}` {
+			t.Error("publish args", args)
+		}
+	case <-timeout:
+		t.Fatal("wait publish timeout")
+	}
+
+	hall.Unsubscribe("game.*")
+	if topics := hall.clients.subscribedTopics(); len(topics) != 0 {
+		t.Error("unsubscribe topics", topics)
+	}
+}
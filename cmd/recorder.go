@@ -0,0 +1,374 @@
+package cmd
+
+// 2021-10-20 消息录制与回放，用于线下复现问题
+// 录制收到及发送的消息，JSON行格式，超过大小后轮转。由单独的协程写入文件
+// 回放时将收到的消息按原速度或加速送入CmdSet，或发送到运行中的服务
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/guogeer/quasar/log"
+)
+
+const (
+	RecordIn  = "in"  // 收到的消息
+	RecordOut = "out" // 发送的消息
+
+	defaultRecordMaxSize    = 100 << 20 // 100M
+	defaultRecordMaxBackups = 5
+	recordQueueSize         = 4 << 10
+	recordBufferSize        = 64 << 10
+)
+
+type Record struct {
+	Time time.Time
+	Dir  string // in|out
+	Package
+}
+
+type recorder struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	// 仅写协程访问
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+
+	ch        chan *Record
+	dropped   int64 // 队列满时丢弃的记录数，原子操作
+	quit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var defaultRecorder atomic.Value // *recorder
+
+// 开始录制，maxSize字节，超过后轮转并保留maxBackups个文件。参数为0时使用默认值
+func StartRecord(path string, maxSize int64, maxBackups int) error {
+	if maxSize <= 0 {
+		maxSize = defaultRecordMaxSize
+	}
+	if maxBackups <= 0 {
+		maxBackups = defaultRecordMaxBackups
+	}
+	r := &recorder{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		ch:         make(chan *Record, recordQueueSize),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	go r.run()
+	if old, _ := defaultRecorder.Load().(*recorder); old != nil {
+		old.close()
+	}
+	defaultRecorder.Store(r)
+	return nil
+}
+
+// 停止录制，等待剩余的记录写入文件
+func StopRecord() {
+	if r, _ := defaultRecorder.Load().(*recorder); r != nil {
+		defaultRecorder.Store((*recorder)(nil))
+		r.close()
+	}
+}
+
+func (r *recorder) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	if r.w == nil {
+		r.w = bufio.NewWriterSize(f, recordBufferSize)
+	} else {
+		r.w.Reset(f)
+	}
+	return nil
+}
+
+func (r *recorder) close() {
+	r.closeOnce.Do(func() { close(r.quit) })
+	<-r.done
+}
+
+// 队列满时丢弃，不阻塞消息处理
+func (r *recorder) push(rec *Record) {
+	select {
+	case r.ch <- rec:
+	default:
+		atomic.AddInt64(&r.dropped, 1)
+	}
+}
+
+// 写协程
+func (r *recorder) run() {
+	ticker := time.NewTicker(time.Second)
+	defer func() {
+		ticker.Stop()
+		r.flush()
+		if r.f != nil {
+			r.f.Close()
+			r.f = nil
+		}
+		close(r.done)
+	}()
+
+	for {
+		select {
+		case rec := <-r.ch:
+			r.write(rec)
+		case <-ticker.C:
+			r.flush()
+			if n := atomic.SwapInt64(&r.dropped, 0); n > 0 {
+				log.Warnf("record queue is full, drop %d records", n)
+			}
+		case <-r.quit:
+			for {
+				select {
+				case rec := <-r.ch:
+					r.write(rec)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *recorder) flush() {
+	if r.f == nil {
+		return
+	}
+	if err := r.w.Flush(); err != nil {
+		log.Warnf("flush record %v", err)
+	}
+}
+
+// 重命名当前文件，删除多余的旧文件。失败时继续写入原文件
+func (r *recorder) rotate() error {
+	r.flush()
+	r.f.Close()
+	r.f = nil
+
+	backup := r.path + "." + time.Now().Format("20060102150405.000000")
+	renameErr := os.Rename(r.path, backup)
+	if renameErr == nil {
+		if backups, _ := filepath.Glob(r.path + ".*"); len(backups) > r.maxBackups {
+			sort.Strings(backups)
+			for _, path := range backups[:len(backups)-r.maxBackups] {
+				os.Remove(path)
+			}
+		}
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+func (r *recorder) write(rec *Record) {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		log.Warnf("record %s %v", rec.Id, err)
+		return
+	}
+	buf = append(buf, '\n')
+
+	// 上次打开失败时重新打开
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			log.Warnf("open record file %v", err)
+			return
+		}
+	}
+	if r.size > 0 && r.size+int64(len(buf)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			log.Warnf("rotate record file %v", err)
+			if r.f == nil {
+				return
+			}
+		}
+	}
+	n, err := r.w.Write(buf)
+	r.size += int64(n)
+	if err != nil {
+		log.Warnf("write record %v", err)
+	}
+}
+
+// 连接状态变化时内部调用的消息，不是收到的消息，不录制及回放
+var internalMessages = map[string]bool{
+	"CMD_Close":        true,
+	"FUNC_Close":       true,
+	"CMD_AutoConnect":  true,
+	"FUNC_ServerClose": true,
+}
+
+// 录制收到的消息
+func recordIn(ctx *Context, msgId string, data []byte) {
+	r, _ := defaultRecorder.Load().(*recorder)
+	if r == nil || internalMessages[msgId] {
+		return
+	}
+	// 录制文件为JSON格式
+	data, err := marshalJSON(data)
+	if err != nil {
+		return
+	}
+	r.push(&Record{
+		Time: time.Now(),
+		Dir:  RecordIn,
+		Package: Package{
+			Id:         msgId,
+			Data:       data,
+			Ssid:       ctx.Ssid,
+			Version:    ctx.Version,
+			ServerName: ctx.ServerName,
+			ClientAddr: ctx.ClientAddr,
+			ReqId:      ctx.ReqId,
+			TraceId:    ctx.TraceId,
+			SpanId:     ctx.ParentSpanId,
+		},
+	})
+}
+
+// 录制发送的消息，包括网关发送到客户端的消息
+// 消息体发送后可能被修改，在当前协程编码
+func RecordSend(pkg *Package) {
+	r, _ := defaultRecorder.Load().(*recorder)
+	if r == nil {
+		return
+	}
+	rec := &Record{Time: time.Now(), Dir: RecordOut, Package: *pkg}
+	if rec.Data == nil {
+		data, err := marshalJSON(pkg.Body)
+		if err != nil {
+			return
+		}
+		rec.Data = data
+	}
+	rec.Body = nil
+	r.push(rec)
+}
+
+// 逐条读取录制的消息
+func ReadRecords(r io.Reader, f func(*Record) error) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		rec := &Record{}
+		if err := dec.Decode(rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := f(rec); err != nil {
+			return err
+		}
+	}
+}
+
+type ReplayOptions struct {
+	Speed  float64            // 回放速度，1为原速度，2为两倍速，不大于0时不等待
+	Filter func(*Record) bool // 过滤收到的消息，为空时回放全部
+}
+
+// 按录制的时间间隔回放收到的消息
+func replayRecords(ctx context.Context, r io.Reader, opts ReplayOptions, f func(*Record) error) error {
+	var start, replayStart time.Time
+	return ReadRecords(r, func(rec *Record) error {
+		if rec.Dir != RecordIn || internalMessages[rec.Id] || (opts.Filter != nil && !opts.Filter(rec)) {
+			return nil
+		}
+		if start.IsZero() {
+			start, replayStart = rec.Time, time.Now()
+		}
+		if opts.Speed > 0 {
+			d := time.Duration(float64(rec.Time.Sub(start))/opts.Speed) - time.Since(replayStart)
+			if d > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(d):
+				}
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return f(rec)
+	})
+}
+
+// 回放到当前节点，入队的消息立即处理。out接收回复，为空时丢弃
+func (node *Node) Replay(ctx context.Context, r io.Reader, opts ReplayOptions, out Conn) error {
+	if out == nil {
+		out = NewRecordConn()
+	}
+	return replayRecords(ctx, r, opts, func(rec *Record) error {
+		msgCtx := &Context{
+			Out:          out,
+			Ssid:         rec.Ssid,
+			Version:      rec.Version,
+			ServerName:   rec.ServerName,
+			ClientAddr:   rec.ClientAddr,
+			ReqId:        rec.ReqId,
+			TraceId:      rec.TraceId,
+			ParentSpanId: rec.SpanId,
+		}
+		if err := node.Handle(msgCtx, rec.Id, rec.Data); err != nil {
+			log.Debugf("replay %s %v", rec.Id, err)
+		}
+		node.waitAndRunOnce(256, 0)
+		return nil
+	})
+}
+
+// 回放到运行中的服务，忽略回复
+func ReplayTo(ctx context.Context, addr string, r io.Reader, opts ReplayOptions) error {
+	rwc, err := dial(addr)
+	if err != nil {
+		return err
+	}
+	defer rwc.Close()
+
+	c := &TCPConn{rwc: rwc}
+	firstPackage, _ := defaultAuthParser.Encode(&Package{})
+	if _, err := c.writeMsg(AuthMessage, firstPackage); err != nil {
+		return err
+	}
+	// 读取并丢弃回复，避免对方发送阻塞
+	go io.Copy(io.Discard, rwc)
+
+	return replayRecords(ctx, r, opts, func(rec *Record) error {
+		pkg := rec.Package
+		pkg.Body = pkg.Data
+		buf, err := defaultRawParser.Encode(&pkg)
+		if err != nil {
+			return err
+		}
+		_, err = c.writeMsg(RawMessage, buf)
+		return err
+	})
+}
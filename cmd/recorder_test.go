@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "record.log")
+	if err := StartRecord(path, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	node := NewNode()
+	NodeOn(node, "TestRecord", func(ctx *Context, args *testCodecArgs) {})
+	for i := 0; i < 3; i++ {
+		node.Handle(&Context{Ssid: "abc", Version: 2}, "TestRecord", []byte(`{"N":1}`))
+	}
+	newTCPConn("", nil).WriteJSON("TestRecordOut", &testCodecArgs{N: 2})
+	// 连接关闭时内部调用的消息不录制
+	node.Handle(&Context{Ssid: "abc"}, "FUNC_Close", nil)
+	StopRecord()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var in, out int
+	ReadRecords(f, func(rec *Record) error {
+		if rec.Id == "FUNC_Close" {
+			t.Error("record internal message", rec.Id)
+		}
+		if rec.Dir == RecordIn && rec.Id == "TestRecord" && rec.Ssid == "abc" && rec.Version == 2 {
+			in++
+		}
+		if rec.Dir == RecordOut && rec.Id == "TestRecordOut" && string(rec.Data) == `{"N":2,"S":""}` {
+			out++
+		}
+		return nil
+	})
+	if in != 3 || out != 1 {
+		t.Fatal("records", in, out)
+	}
+
+	var replayed []string
+	node2 := NewNode()
+	NodeOn(node2, "TestRecord", func(ctx *Context, args *testCodecArgs) {
+		replayed = append(replayed, ctx.Ssid)
+	})
+	f.Seek(0, 0)
+	opts := ReplayOptions{Filter: func(rec *Record) bool { return rec.Id == "TestRecord" }}
+	if err := node2.Replay(context.Background(), f, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 3 || replayed[0] != "abc" {
+		t.Error("replay", replayed)
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		enc.Encode(&Record{Time: start.Add(time.Duration(i) * 100 * time.Millisecond), Dir: RecordIn, Package: Package{Id: "TestReplay"}})
+	}
+
+	var n int
+	node := NewNode()
+	NodeOnWithoutQueue(node, "TestReplay", func(ctx *Context, args *testCodecArgs) { n++ })
+	replayStart := time.Now()
+	if err := node.Replay(context.Background(), buf, ReplayOptions{Speed: 2}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(replayStart); n != 3 || d < 100*time.Millisecond || d > time.Second {
+		t.Error("replay speed", n, d)
+	}
+}
+
+func TestRecordRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "record.log")
+	if err := StartRecord(path, 256, 2); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		recordIn(&Context{Ssid: "abc"}, "TestRotate", []byte(`{"N":1}`))
+		time.Sleep(time.Millisecond)
+	}
+	StopRecord()
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Error("record backups", backups)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() > 256 {
+		t.Error("record file", err)
+	}
+}
+
+func TestRecordRotateFail(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "record.log")
+	r := &recorder{path: path, maxSize: 64, maxBackups: 2}
+	if err := r.open(); err != nil {
+		t.Fatal(err)
+	}
+	r.write(&Record{Package: Package{Id: "TestRotateFail"}})
+	// 文件已删除，重命名失败
+	os.Remove(path)
+	r.write(&Record{Package: Package{Id: "TestRotateFail"}})
+	if r.f == nil {
+		t.Fatal("stop record after rotate fail")
+	}
+	r.flush()
+	r.f.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Size() == 0 {
+		t.Error("record after rotate fail", err)
+	}
+}
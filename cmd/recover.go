@@ -0,0 +1,69 @@
+package cmd
+
+// 2021-08-26 消息处理异常时恢复，避免单个消息导致服务退出
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/guogeer/quasar/log"
+)
+
+// 处理异常时是否回复错误
+var enablePanicReply = false
+
+type panicStats struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (ps *panicStats) add(msgId string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.counts == nil {
+		ps.counts = map[string]int64{}
+	}
+	ps.counts[msgId]++
+}
+
+func (ps *panicStats) get() map[string]int64 {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	counts := make(map[string]int64, len(ps.counts))
+	for id, n := range ps.counts {
+		counts[id] = n
+	}
+	return counts
+}
+
+// 各消息处理异常的次数
+func (node *Node) PanicStats() map[string]int64 {
+	return node.panics.get()
+}
+
+func (node *Node) recoverHandler(name string, h Handler) Handler {
+	return func(ctx *Context, args interface{}) {
+		defer func() {
+			if err := recover(); err != nil {
+				const size = 64 << 10
+				buf := make([]byte, size)
+				buf = buf[:runtime.Stack(buf, false)]
+				// Enqueue的上下文可能为空
+				var ssid string
+				if ctx != nil {
+					ssid = ctx.Ssid
+				}
+				log.Errorf("handle message %s ssid %s panic: %v\n%s", name, ssid, err, buf)
+
+				node.panics.add(name)
+				if ctx != nil {
+					ctx.Fail()
+					if enablePanicReply {
+						ctx.Error(CodeInternal, "internal error")
+					}
+				}
+			}
+		}()
+		h(ctx, args)
+	}
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import "testing"
+
+type testReplyConn struct {
+	replies []string
+}
+
+func (c *testReplyConn) Write([]byte) error { return nil }
+func (c *testReplyConn) RemoteAddr() string { return "" }
+func (c *testReplyConn) Close()             {}
+
+func (c *testReplyConn) WriteJSON(name string, i interface{}) error {
+	c.replies = append(c.replies, name)
+	return nil
+}
+
+func TestRecoverHandler(t *testing.T) {
+	enablePanicReply = true
+	defer func() { enablePanicReply = false }()
+
+	node := NewNode()
+	h := func(ctx *Context, args interface{}) { panic("test panic") }
+	node.BindWithName("TestPanic", h, (*testCodecArgs)(nil))
+	node.BindWithoutQueue("TestPanicWithoutQueue", h, (*testCodecArgs)(nil))
+
+	out := &testReplyConn{}
+	for _, id := range []string{"TestPanic", "TestPanic", "TestPanicWithoutQueue"} {
+		if err := node.Handle(&Context{Out: out, Ssid: "ssid"}, id, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	node.waitAndRunOnce(8, 0)
+
+	stats := node.PanicStats()
+	if stats["TestPanic"] != 2 || stats["TestPanicWithoutQueue"] != 1 {
+		t.Error("panic stats", stats)
+	}
+	if len(out.replies) != 3 || out.replies[0] != ErrorReplyId {
+		t.Error("panic replies", out.replies)
+	}
+
+	// 未开启时不回复
+	enablePanicReply = false
+	out.replies = nil
+	node.Handle(&Context{Out: out}, "TestPanicWithoutQueue", nil)
+	if len(out.replies) != 0 {
+		t.Error("reply when disabled", out.replies)
+	}
+}
+
+func TestRecoverEnqueue(t *testing.T) {
+	node := NewNode()
+	out := &testReplyConn{}
+	node.Enqueue(&Context{Out: out}, func(ctx *Context, args interface{}) { panic("test panic") }, nil)
+	node.waitAndRunOnce(8, 0)
+
+	var n int64
+	for _, count := range node.PanicStats() {
+		n += count
+	}
+	if n != 1 {
+		t.Error("enqueue panic stats", node.PanicStats())
+	}
+}
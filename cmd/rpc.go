@@ -0,0 +1,116 @@
+package cmd
+
+// 2021-07-10 同步请求复用已建立的连接，通过请求ID匹配回复
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	lastReqId uint64
+
+	errConnClosed = errors.New("connection closed")
+)
+
+// 同步请求超时时间
+const defaultCallTimeout = 5 * time.Second
+
+func (c *Client) addCall(id uint64) chan *Package {
+	reply := make(chan *Package, 1)
+
+	c.callMu.Lock()
+	defer c.callMu.Unlock()
+	c.calls[id] = reply
+	return reply
+}
+
+func (c *Client) removeCall(id uint64) {
+	c.callMu.Lock()
+	defer c.callMu.Unlock()
+	delete(c.calls, id)
+}
+
+// 回复请求方，未找到请求时返回false
+func (c *Client) replyCall(pkg *Package) bool {
+	c.callMu.Lock()
+	defer c.callMu.Unlock()
+	reply, ok := c.calls[pkg.ReqId]
+	if ok {
+		delete(c.calls, pkg.ReqId)
+		reply <- pkg
+	}
+	return ok
+}
+
+// 连接断开后，等待中的请求立即返回
+func (c *Client) cancelCalls() {
+	c.callMu.Lock()
+	defer c.callMu.Unlock()
+	for id, reply := range c.calls {
+		close(reply)
+		delete(c.calls, id)
+	}
+}
+
+// 对方通过ctx.WriteJSON或ctx.Out.WriteJSON回复
+func (cm *clientManage) Call(ctx context.Context, serverName, msgId string, in, out interface{}) error {
+	serverName, msgId = routeMessage(serverName, msgId)
+	client := cm.getClient(serverName, "")
+
+	id := atomic.AddUint64(&lastReqId, 1)
+	reply := client.addCall(id)
+	defer client.removeCall(id)
+
+	pkg := &Package{Id: msgId, Body: in, ReqId: id}
+	if err := client.route(pkg); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case resp, ok := <-reply:
+		if !ok {
+			return errConnClosed
+		}
+		if err := packageError(resp); err != nil {
+			return err
+		}
+		if out != nil {
+			return unmarshalData(resp.Data, out)
+		}
+	}
+	return nil
+}
+
+// 同步请求，复用已建立的连接
+func Call(ctx context.Context, serverName, msgId string, in, out interface{}) error {
+	return DefaultNode().Call(ctx, serverName, msgId, in, out)
+}
+
+// 同步请求的连接，首条回复携带请求ID。处理函数直接通过ctx.Out回复时使用
+type replyConn struct {
+	Conn
+	reqId uint64
+}
+
+func newReplyConn(c Conn, reqId uint64) Conn {
+	if _, ok := c.(packageWriter); !ok || reqId == 0 {
+		return c
+	}
+	return &replyConn{Conn: c, reqId: reqId}
+}
+
+func (c *replyConn) WriteJSON(name string, i interface{}) error {
+	return c.WritePackage(&Package{Id: name, Body: i})
+}
+
+func (c *replyConn) WritePackage(pkg *Package) error {
+	if id := atomic.SwapUint64(&c.reqId, 0); id != 0 && pkg.ReqId == 0 {
+		pkg.ReqId = id
+	}
+	return c.Conn.(packageWriter).WritePackage(pkg)
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCall(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := NewNode(), NewNode()
+	srv := &Server{Node: server}
+	go srv.Serve(l)
+	defer srv.Shutdown(context.Background())
+	client.SetRouterAddr(l.Addr().String())
+
+	server.BindWithoutQueue("TestCallEcho", func(ctx *Context, data interface{}) {
+		ctx.WriteJSON("TestCallEcho", data)
+	}, (*testCodecArgs)(nil))
+	server.BindWithoutQueue("TestCallOut", func(ctx *Context, data interface{}) {
+		ctx.Out.WriteJSON("TestCallOut", data)
+	}, (*testCodecArgs)(nil))
+	server.BindWithoutQueue("TestCallNoReply", func(ctx *Context, data interface{}) {}, (*testCodecArgs)(nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	for i := 0; i < 8; i++ {
+		out := &testCodecArgs{}
+		if err := client.Call(ctx, "router", "TestCallEcho", &testCodecArgs{N: i}, out); err != nil {
+			t.Fatal(err)
+		}
+		if out.N != i {
+			t.Errorf("call reply %d, expect %d", out.N, i)
+		}
+	}
+
+	// 直接通过连接回复
+	out := &testCodecArgs{}
+	if err := client.Call(ctx, "router", "TestCallOut", &testCodecArgs{N: 9}, out); err != nil || out.N != 9 {
+		t.Error("call reply by ctx.Out", out, err)
+	}
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+	if err := client.Call(ctx2, "router", "TestCallNoReply", nil, nil); err != context.DeadlineExceeded {
+		t.Error("call without reply", err)
+	}
+}
@@ -5,24 +5,96 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/guogeer/quasar/log"
 	"github.com/guogeer/quasar/util"
 )
 
+var ErrServerClosed = errors.New("cmd: server closed")
+
 type Server struct {
-	Addr string
+	Addr      string
+	TLSConfig *tls.Config // 为空时使用配置的证书
+	Node      *Node       // 为空时使用默认节点
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]bool
+	conns      map[*ServeConn]bool
+	inShutdown bool
+	wg         sync.WaitGroup // 连接写协程
+}
+
+func (srv *Server) trackListener(l net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.listeners == nil {
+		srv.listeners = map[net.Listener]bool{}
+	}
+	if add {
+		if srv.inShutdown {
+			return false
+		}
+		srv.listeners[l] = true
+	} else {
+		delete(srv.listeners, l)
+	}
+	return true
+}
+
+// 关闭中不再添加连接，与Shutdown获取连接列表互斥
+func (srv *Server) trackConn(c *ServeConn, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.conns == nil {
+		srv.conns = map[*ServeConn]bool{}
+	}
+	if add {
+		if srv.inShutdown {
+			return false
+		}
+		srv.conns[c] = true
+		srv.wg.Add(1)
+	} else {
+		delete(srv.conns, c)
+		srv.wg.Done()
+	}
+	return true
+}
+
+func (srv *Server) node() *Node {
+	if srv.Node == nil {
+		return DefaultNode()
+	}
+	return srv.Node
+}
+
+func (srv *Server) shuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.inShutdown
 }
 
 func (srv *Server) Serve(l net.Listener) error {
 	defer l.Close()
+	if !srv.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(l, false)
+
 	var tempDelay time.Duration
 	for {
 		rwc, err := l.Accept()
 		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -38,29 +110,88 @@ func (srv *Server) Serve(l net.Listener) error {
 			return err
 		}
 		tempDelay = 0
+		if srv.shuttingDown() {
+			rwc.Close()
+			return ErrServerClosed
+		}
 
 		ssid := util.GUID()
 		c := &ServeConn{
-			server: srv,
-			TCPConn: &TCPConn{
-				ssid: ssid,
-				rwc:  rwc,
-				send: make(chan []byte, 32<<10),
-			},
+			server:  srv,
+			TCPConn: newTCPConn(ssid, rwc),
 		}
 		// log.Info("create guid", ssid)
-		AddSession(&Session{Id: ssid, Out: c})
+		if !srv.trackConn(c, true) {
+			rwc.Close()
+			return ErrServerClosed
+		}
+		srv.node().AddSession(&Session{Id: ssid, Out: c})
 		go c.serve()
 	}
 }
 
+// 优雅关闭
+// 1、停止接收新连接
+// 2、关闭已有连接的发送队列，剩余消息发送完成后断开，并触发CMD_Close、FUNC_Close
+// 3、等待所有连接关闭或ctx结束
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.inShutdown = true
+	for l := range srv.listeners {
+		l.Close()
+	}
+	conns := make([]*ServeConn, 0, len(srv.conns))
+	for c := range srv.conns {
+		conns = append(conns, c)
+	}
+	srv.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 多个地址以逗号分隔，同时监听。返回第一个退出的错误
 func (srv *Server) ListenAndServe() error {
-	addr := srv.Addr
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Fatalf("listen %v", err)
+	tlsConfig := srv.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = serverTLSConfig
+	}
+
+	addrs := splitAddrs(srv.Addr)
+	if len(addrs) == 0 {
+		addrs = []string{srv.Addr}
 	}
-	return srv.Serve(l)
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		l, err := listen(addr)
+		if err != nil {
+			log.Fatalf("listen %v", err)
+		}
+		// 进程内及unix socket的连接不加密
+		if tlsConfig != nil && !isMemAddr(addr) && !isUnixAddr(addr) {
+			l = tls.NewListener(l, tlsConfig)
+		}
+		listeners = append(listeners, l)
+	}
+
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) { errc <- srv.Serve(l) }(l)
+	}
+	return <-errc
 }
 
 func ListenAndServe(addr string) error {
@@ -74,30 +205,44 @@ type ServeConn struct {
 }
 
 func (c *ServeConn) serve() {
+	// 新连接5s内未收到有效数据判定无效
+	c.rwc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := c.handshake(); err != nil {
+		log.Debugf("handshake %v", err)
+		c.rwc.Close()
+		c.server.node().RemoveSession(c.ssid)
+		c.server.trackConn(c, false)
+		return
+	}
+	c.rwc.SetReadDeadline(time.Now().Add(pongWait))
+
 	pong := make(chan bool, 1)
 	doneCtx, cancel := context.WithCancel(context.Background())
 	go func() {
 		defer func() {
-			// 关闭网络连接
+			// 关闭网络连接，写协程退出后不再入队
 			c.rwc.Close()
+			c.send.Close()
 			// 当前上下文
+			node := c.server.node()
 			ctx := &Context{Ssid: c.ssid, Out: c}
-			defaultCmdSet.Handle(ctx, "CMD_Close", nil)
-			defaultCmdSet.Handle(ctx, "FUNC_Close", nil)
+			node.Handle(ctx, "CMD_Close", nil)
+			node.Handle(ctx, "FUNC_Close", nil)
 
 			// 删除会话
-			RemoveSession(c.ssid)
+			node.RemoveSession(c.ssid)
+			c.server.trackConn(c, false)
 		}()
 
 		for {
 			select {
-			case buf, ok := <-c.send:
+			case buf, ok := <-c.send.C():
 				if !ok {
 					return
 				}
 				// 忽略过大消息
-				if _, err := c.writeMsg(RawMessage, buf); err != nil {
-					log.Debugf("write %v", err)
+				if _, err := c.writeRaw(buf); err != nil {
+					log.Errorf("write %d bytes %v", len(buf), err)
 					if err != errTooLargeMessage {
 						return
 					}
@@ -116,10 +261,7 @@ func (c *ServeConn) serve() {
 		cancel() // 读关闭通知
 		close(pong)
 	}()
-	// 新连接5s内未收到有效数据判定无效
-	c.rwc.SetReadDeadline(time.Now().Add(5 * time.Second))
 
-	var isAuth bool
 	for {
 		mt, buf, err := c.TCPConn.ReadMessage()
 		if err != nil {
@@ -128,35 +270,82 @@ func (c *ServeConn) serve() {
 			}
 			return
 		}
-		if !isAuth {
-			if _, err = defaultAuthParser.Decode(buf); err != nil {
-				return
-			}
-		}
 		if mt == PingMessage {
 			pong <- true
-		}
-		if !isAuth || mt == PingMessage {
 			c.rwc.SetReadDeadline(time.Now().Add(pongWait))
 		}
-
-		isAuth = true
 		if mt == RawMessage {
-			pkg, err := defaultRawParser.Decode(buf)
+			pkg, err := unmarshalPackage(buf)
 			if err != nil {
 				return
 			}
+			if err := c.checkNonce(pkg); err != nil {
+				log.Debugf("check package[%s] %v", pkg.Id, err)
+				return
+			}
 
 			ctx := &Context{
-				Out:        c,
+				Out:        newReplyConn(c, pkg.ReqId),
 				Ssid:       pkg.Ssid,
 				ServerName: pkg.ServerName,
 				ClientAddr: pkg.ClientAddr,
+				Version:    pkg.Version,
+				ReqId:      pkg.ReqId,
 			}
-			err = defaultCmdSet.Handle(ctx, pkg.Id, pkg.Data)
+			ctx.continueTrace(pkg)
+			err = c.server.node().Handle(ctx, pkg.Id, pkg.Data)
 			if err != nil {
-				log.Debugf("handle msg[%s] error: %v", buf, err)
+				log.Debugf("handle msg[%s] error: %v", pkg.Id, err)
 			}
 		}
 	}
 }
+
+// 第一个包为校验数据，同时协商编码
+func (c *ServeConn) handshake() error {
+	mt, buf, err := c.TCPConn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	pkg, err := defaultAuthParser.Decode(buf)
+	if err != nil {
+		return err
+	}
+	if err := c.checkNonce(pkg); err != nil {
+		return err
+	}
+
+	args := &authArgs{}
+	if mt != AuthMessage || json.Unmarshal(pkg.Data, args) != nil || args.Codec == "" {
+		return nil
+	}
+	codec := GetCodec(args.Codec)
+	if codec == nil {
+		codec = defaultCodec
+	}
+	c.setCodec(codec)
+
+	// 回复协商结果，未配置阈值时不压缩
+	result := &authArgs{Codec: codec.Name()}
+	compressor, threshold := NegotiateCompressor(args.Compress), DefaultCompressThreshold()
+	if compressor != nil && threshold > 0 {
+		result.Compress, result.Threshold = compressor.Name(), threshold
+	}
+	ack := &Package{
+		SignType: "md5",
+		ExpireTs: time.Now().Add(5 * time.Second).Unix(),
+		Body:     result,
+	}
+	buf, err = ack.Encode()
+	if err != nil {
+		return err
+	}
+	if _, err = c.writeMsg(AuthMessage, buf); err != nil {
+		return err
+	}
+	// 回复之后的消息压缩
+	if result.Compress != "" {
+		c.setCompress(compressor, threshold)
+	}
+	return nil
+}
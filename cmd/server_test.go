@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(l) }()
+
+	rwc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rwc.Close()
+	c := &TCPConn{rwc: rwc}
+	auth, _ := (&Package{SignType: "md5"}).Encode()
+	c.writeMsg(AuthMessage, auth)
+	c.writeMsg(PingMessage, nil)
+	if mt, _, err := c.ReadMessage(); err != nil || mt != PongMessage {
+		t.Fatal("wait pong", mt, err)
+	}
+
+	srv.mu.Lock()
+	for sc := range srv.conns {
+		sc.WriteJSON("TestFlush", struct{}{})
+	}
+	srv.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Error("serve return", err)
+	}
+
+	// 关闭前发送剩余消息
+	mt, buf, err := c.ReadMessage()
+	if err != nil || mt != RawMessage {
+		t.Fatal("read flush message", mt, err)
+	}
+	if pkg, _ := unmarshalPackage(buf); pkg == nil || pkg.Id != "TestFlush" {
+		t.Error("invalid flush message", string(buf))
+	}
+	if _, _, err := c.ReadMessage(); err != io.EOF {
+		t.Error("connection not closed", err)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("listener not closed")
+	}
+}
+
+func TestServerRejectAfterShutdown(t *testing.T) {
+	srv := &Server{}
+	srv.Shutdown(context.Background())
+
+	c := &ServeConn{server: srv, TCPConn: newTCPConn("", nil)}
+	if srv.trackConn(c, true) {
+		t.Error("track conn after shutdown")
+	}
+}
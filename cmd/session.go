@@ -6,9 +6,40 @@ import (
 	"github.com/guogeer/quasar/log"
 )
 
+type packageWriter interface {
+	WritePackage(*Package) error
+}
+
 type Session struct {
-	Id  string
-	Out Conn
+	Id      string
+	Out     Conn
+	Version int    // 协商的协议版本，Route时透传
+	TraceId string // 最近一条客户端消息的链路，网关通过SetTrace更新，Route时透传
+	SpanId  string
+
+	node    *Node
+	traceMu sync.RWMutex
+}
+
+// 网关创建链路后更新会话的链路
+func (ss *Session) SetTrace(ctx *Context) {
+	ss.traceMu.Lock()
+	defer ss.traceMu.Unlock()
+	ss.TraceId, ss.SpanId = ctx.TraceId, ctx.SpanId
+}
+
+func (ss *Session) traceTo(pkg *Package) *Package {
+	ss.traceMu.RLock()
+	defer ss.traceMu.RUnlock()
+	pkg.TraceId, pkg.SpanId = ss.TraceId, ss.SpanId
+	return pkg
+}
+
+func (ss *Session) getNode() *Node {
+	if ss.node == nil {
+		return DefaultNode()
+	}
+	return ss.node
 }
 
 func (ss *Session) GetServerName() string {
@@ -23,27 +54,26 @@ func (ss *Session) routeContext(ctx *Context, name string, i interface{}) {
 		Body:       i,
 		Ssid:       ss.Id,
 		ServerName: ctx.ServerName,
-		SignType:   "raw",
 		ClientAddr: ctx.ClientAddr,
+		Version:    ctx.Version,
 	}
-	buf, err := pkg.Encode()
-	if err != nil {
-		return
-	}
-	defaultClientManage.Route(ctx.MatchServer, buf)
+	ctx.traceTo(pkg)
+	ctx.Node().clients.Route(ctx.MatchServer, pkg)
 }
 
-func (ss *Session) Route(serverName, name string, i interface{}) {
-	pkg := &Package{Id: name, Body: i, Ssid: ss.Id, ServerName: serverName, SignType: "raw"}
-	buf, err := pkg.Encode()
-	if err != nil {
-		return
-	}
-	defaultClientManage.Route(serverName, buf)
+// 服务不可用时返回错误。透传会话的链路
+func (ss *Session) Route(serverName, name string, i interface{}) error {
+	pkg := ss.traceTo(&Package{Id: name, Body: i, Ssid: ss.Id, ServerName: serverName, Version: ss.Version})
+	return ss.getNode().clients.Route(serverName, pkg)
 }
 
 func (ss *Session) WriteJSON(name string, i interface{}) {
 	pkg := &Package{Id: name, Body: i, Ssid: ss.Id, SignType: "raw"}
+	// 服务内部连接使用协商的编码
+	if c, ok := ss.Out.(packageWriter); ok {
+		c.WritePackage(pkg)
+		return
+	}
 	buf, err := pkg.Encode()
 	if err != nil {
 		return
@@ -56,10 +86,8 @@ type SessionManage struct {
 	mu       sync.RWMutex
 }
 
-var defaultSessionManage = &SessionManage{sessions: make(map[string]*Session)}
-
 func GetSessionManage() *SessionManage {
-	return defaultSessionManage
+	return DefaultNode().GetSessionManage()
 }
 
 func (sm *SessionManage) Add(s *Session) {
@@ -102,17 +130,17 @@ func (sm *SessionManage) Count() int {
 }
 
 func AddSession(s *Session) {
-	defaultSessionManage.Add(s)
+	DefaultNode().AddSession(s)
 }
 
 func RemoveSession(id string) {
-	defaultSessionManage.Del(id)
+	DefaultNode().RemoveSession(id)
 }
 
 func GetSession(id string) *Session {
-	return defaultSessionManage.Get(id)
+	return DefaultNode().GetSession(id)
 }
 
 func GetSessionList() []*Session {
-	return defaultSessionManage.GetList()
+	return DefaultNode().GetSessionList()
 }
@@ -0,0 +1,123 @@
+package cmd
+
+// 2021-07-26 支持HMAC-SHA256签名
+// 1、配置多个密钥，第一个用于签名，其余仅用于校验，轮换密钥时不需要停服
+// 2、签名模式下消息需携带Nonce与ExpireTs，同一会话在有效期内重复的Nonce视为重放
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+)
+
+const (
+	hmacSignExpire = 30 * time.Second // 签名有效期
+	maxNonceWindow = 5 * time.Minute  // 过期时间超过该值的消息拒绝
+)
+
+var (
+	enableHMACSign = false
+	hmacTempSign   = strings.Repeat("0", sha256.Size*2)
+
+	errUnknownSignKey = errors.New("unknown sign key")
+	errReplayPackage  = errors.New("replay package")
+)
+
+// keyId为签名使用的密钥
+func (parser *hashParser) setHMACKeys(keyId string, keys map[string]string) error {
+	if _, ok := keys[keyId]; !ok {
+		return errors.New("empty hmac sign keys")
+	}
+	parser.hmacKeys = map[string][]byte{}
+	for id, key := range keys {
+		parser.hmacKeys[id] = []byte(key)
+	}
+	parser.hmacKeyId = keyId
+	parser.tempSign = hmacTempSign
+	return nil
+}
+
+func (parser *hashParser) prepareHMAC(pkg *Package) {
+	pkg.KeyId = parser.hmacKeyId
+	if pkg.Nonce == "" {
+		pkg.Nonce = newNonce()
+	}
+	if pkg.ExpireTs == 0 {
+		pkg.ExpireTs = time.Now().Add(hmacSignExpire).Unix()
+	}
+}
+
+func (parser *hashParser) signatureHMAC(data []byte) (string, error) {
+	keyId, _ := jsonparser.GetString(data, "KeyId")
+	key, ok := parser.hmacKeys[keyId]
+	if !ok {
+		return "", errUnknownSignKey
+	}
+	_, _, n, err := jsonparser.Get(data, "Sign")
+	if err != nil {
+		return "", err
+	}
+	signLen := len(hmacTempSign) + 1
+	if n < signLen {
+		return "", ErrInvalidSign
+	}
+	buf := append([]byte{}, data...)
+	copy(buf[n-signLen:], hmacTempSign)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf)
+	sign := hex.EncodeToString(mac.Sum(nil))
+	copy(data[n-signLen:n], sign)
+	return sign, nil
+}
+
+func newNonce() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// 会话内已使用的Nonce，过期后清理
+type NonceWindow struct {
+	nonces    map[string]int64
+	lastClean time.Time
+	mu        sync.Mutex
+}
+
+func NewNonceWindow() *NonceWindow {
+	return &NonceWindow{nonces: map[string]int64{}, lastClean: time.Now()}
+}
+
+// 未开启HMAC签名时不校验
+func (w *NonceWindow) Check(pkg *Package) error {
+	if !enableHMACSign {
+		return nil
+	}
+	now := time.Now()
+	if pkg.Nonce == "" || pkg.ExpireTs < now.Unix() || pkg.ExpireTs > now.Add(maxNonceWindow).Unix() {
+		return errReplayPackage
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if now.Sub(w.lastClean) > hmacSignExpire {
+		for nonce, ts := range w.nonces {
+			if ts < now.Unix() {
+				delete(w.nonces, nonce)
+			}
+		}
+		w.lastClean = now
+	}
+	if _, ok := w.nonces[pkg.Nonce]; ok {
+		return errReplayPackage
+	}
+	w.nonces[pkg.Nonce] = pkg.ExpireTs
+	return nil
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHMACSign(t *testing.T) {
+	oldParser, newParser := &hashParser{}, &hashParser{}
+	oldParser.setHMACKeys("k1", map[string]string{"k1": "key1"})
+	// 轮换密钥后，旧密钥仍可校验
+	newParser.setHMACKeys("k2", map[string]string{"k1": "key1", "k2": "key2"})
+
+	buf, err := oldParser.Encode(&Package{Id: "Test", Body: &testCodecArgs{N: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg, err := newParser.Decode(append([]byte{}, buf...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.KeyId != "k1" || pkg.Nonce == "" || pkg.ExpireTs == 0 {
+		t.Errorf("invalid hmac package %v", pkg)
+	}
+
+	tamper := bytes.Replace(buf, []byte(`"N":1`), []byte(`"N":2`), 1)
+	if _, err := newParser.Decode(tamper); err != ErrInvalidSign {
+		t.Error("decode tampered package", err)
+	}
+	buf, _ = newParser.Encode(&Package{Id: "Test"})
+	if _, err := oldParser.Decode(buf); err != ErrInvalidSign {
+		t.Error("decode package with unknown key", err)
+	}
+}
+
+func TestNonceWindow(t *testing.T) {
+	enableHMACSign = true
+	defer func() { enableHMACSign = false }()
+
+	parser := &hashParser{}
+	parser.setHMACKeys("k1", map[string]string{"k1": "key1"})
+	buf, _ := parser.Encode(&Package{Id: "Test"})
+	pkg, err := parser.Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewNonceWindow()
+	if err := w.Check(pkg); err != nil {
+		t.Error("check first package", err)
+	}
+	if err := w.Check(pkg); err != errReplayPackage {
+		t.Error("check replay package", err)
+	}
+	if err := NewNonceWindow().Check(&Package{Nonce: "abc"}); err != errReplayPackage {
+		t.Error("check package without expire time", err)
+	}
+}
+
+func TestConnNonce(t *testing.T) {
+	enableHMACSign = true
+	defer func() { enableHMACSign = false }()
+
+	parser := &hashParser{}
+	parser.setHMACKeys("k1", map[string]string{"k1": "key1"})
+	buf, _ := parser.Encode(&Package{Id: "Test"})
+	pkg, _ := parser.Decode(buf)
+
+	// 每个连接独立校验
+	c1, c2 := newTCPConn("", nil), newTCPConn("", nil)
+	if err := c1.checkNonce(pkg); err != nil {
+		t.Error("check first package", err)
+	}
+	if err := c2.checkNonce(pkg); err != nil {
+		t.Error("check package on other conn", err)
+	}
+	if err := c1.checkNonce(pkg); err != errReplayPackage {
+		t.Error("check replay package", err)
+	}
+	if err := c1.checkNonce(&Package{Id: "Test"}); err != nil {
+		t.Error("check unsigned package", err)
+	}
+}
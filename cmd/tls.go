@@ -0,0 +1,86 @@
+package cmd
+
+// 2021-07-20 服务内部连接支持TLS，可选校验客户端证书
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/guogeer/quasar/config"
+)
+
+var (
+	serverTLSConfig *tls.Config // 未配置证书时为空，使用TCP明文
+	clientTLSConfig *tls.Config
+)
+
+func loadTLSConfig() (*tls.Config, *tls.Config, error) {
+	cfg := config.Config().TLS
+	if cfg.CertFile == "" && cfg.CAFile == "" {
+		return nil, nil, nil
+	}
+
+	var certs []tls.Certificate
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	var pool *x509.CertPool
+	if cfg.CAFile != "" {
+		b, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, nil, errors.New("invalid ca file " + cfg.CAFile)
+		}
+	}
+
+	clientConfig := &tls.Config{
+		Certificates: certs,
+		RootCAs:      pool,
+		ServerName:   cfg.ServerName,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(certs) == 0 {
+		return nil, clientConfig, nil
+	}
+
+	serverConfig := &tls.Config{
+		Certificates: certs,
+		MinVersion:   tls.VersionTLS12,
+	}
+	// 仅集群成员可连接
+	if cfg.VerifyClient {
+		if pool == nil {
+			return nil, nil, errors.New("verify client without ca file")
+		}
+		serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		serverConfig.ClientCAs = pool
+	}
+	return serverConfig, clientConfig, nil
+}
+
+// 连接其他服务
+func dialOne(addr string) (net.Conn, error) {
+	if isMemAddr(addr) {
+		return dialMem(addr)
+	}
+	// 同一主机的连接不加密
+	if isUnixAddr(addr) {
+		return net.Dial("unix", strings.TrimPrefix(addr, unixScheme))
+	}
+	if clientTLSConfig != nil {
+		return tls.Dial("tcp", addr, clientTLSConfig)
+	}
+	return net.Dial("tcp", addr)
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/guogeer/quasar/config"
+)
+
+// 生成证书，parent为空时自签名
+func testCreateCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0644)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600)
+
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := testCreateCert(t, dir, "ca", nil, nil)
+	testCreateCert(t, dir, "node", ca, caKey)
+
+	env := config.Config()
+	oldTLS := env.TLS
+	defer func() { env.TLS = oldTLS }()
+	env.TLS.CertFile = filepath.Join(dir, "node.crt")
+	env.TLS.KeyFile = filepath.Join(dir, "node.key")
+	env.TLS.CAFile = filepath.Join(dir, "ca.crt")
+	env.TLS.VerifyClient = true
+
+	srvConfig, cliConfig, err := loadTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", srvConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			rwc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			rwc.(*tls.Conn).Handshake()
+			rwc.Close()
+		}
+	}()
+
+	addr := l.Addr().String()
+	c, err := tls.Dial("tcp", addr, cliConfig)
+	if err != nil {
+		t.Fatal("cluster member", err)
+	}
+	c.Close()
+
+	// 无客户端证书
+	anonConfig := cliConfig.Clone()
+	anonConfig.Certificates = nil
+	if c, err := tls.Dial("tcp", addr, anonConfig); err == nil {
+		if _, err := c.Read(make([]byte, 1)); err == nil {
+			t.Error("connect without client certificate")
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,141 @@
+package cmd
+
+// 2021-09-10 链路追踪。网关收到客户端消息时创建TraceId
+// 经Session.Route、Forward、C2S_Route透传，每一跳生成新的SpanId
+// 消息处理耗时以JSON行的格式写入本地文件
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/guogeer/quasar/log"
+)
+
+var enableTrace = false
+
+type Span struct {
+	TraceId  string
+	SpanId   string
+	ParentId string `json:",omitempty"`
+	Name     string // 消息ID
+	Ssid     string `json:",omitempty"`
+	Start    time.Time
+	Duration time.Duration
+}
+
+type spanSink struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+var defaultSpanSink atomic.Value // *spanSink
+
+// 追加写入span文件
+func openSpanSink(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defaultSpanSink.Store(&spanSink{f: f, enc: json.NewEncoder(f)})
+	return nil
+}
+
+func (sink *spanSink) write(span *Span) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if err := sink.enc.Encode(span); err != nil {
+		log.Warnf("write span %v", err)
+	}
+}
+
+func recordSpan(ctx *Context, name string, start time.Time) {
+	sink, _ := defaultSpanSink.Load().(*spanSink)
+	if sink == nil || ctx.TraceId == "" {
+		return
+	}
+	sink.write(&Span{
+		TraceId:  ctx.TraceId,
+		SpanId:   ctx.SpanId,
+		ParentId: ctx.ParentSpanId,
+		Name:     name,
+		Ssid:     ctx.Ssid,
+		Start:    start,
+		Duration: time.Since(start),
+	})
+}
+
+func newTraceId(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 创建新的链路，未开启追踪时忽略。网关收到客户端消息时调用
+func (ctx *Context) StartTrace() {
+	if enableTrace {
+		ctx.TraceId, ctx.SpanId, ctx.ParentSpanId = newTraceId(16), newTraceId(8), ""
+	}
+}
+
+// 延续收到的链路
+func (ctx *Context) continueTrace(pkg *Package) {
+	if pkg.TraceId != "" {
+		ctx.TraceId, ctx.SpanId, ctx.ParentSpanId = pkg.TraceId, newTraceId(8), pkg.SpanId
+	}
+}
+
+func (ctx *Context) traceTo(pkg *Package) *Package {
+	pkg.TraceId, pkg.SpanId = ctx.TraceId, ctx.SpanId
+	return pkg
+}
+
+// 发送到指定服务，透传链路
+func (ctx *Context) Route(serverName, messageId string, i interface{}) error {
+	serverName, messageId = routeMessage(serverName, messageId)
+	pkg := ctx.traceTo(&Package{Id: messageId, Body: i, Version: ctx.Version})
+	return ctx.Node().clients.Route(serverName, pkg)
+}
+
+// 通过router转发，透传链路
+func (ctx *Context) Forward(servers interface{}, messageId string, i interface{}) {
+	ctx.Node().forward(ctx, servers, messageId, i)
+}
+
+// 向其他连接发送消息，透传链路。如router转发C2S_Route
+func (ctx *Context) WriteTo(out Conn, name string, i interface{}) error {
+	if c, ok := out.(packageWriter); ok && ctx.TraceId != "" {
+		return c.WritePackage(ctx.traceTo(&Package{Id: name, Body: i}))
+	}
+	return out.WriteJSON(name, i)
+}
+
+func (ctx *Context) output(level, s string) {
+	if ctx.TraceId != "" {
+		s = fmt.Sprintf("[trace %s span %s] %s", ctx.TraceId, ctx.SpanId, s)
+	}
+	log.Output(3, level, s)
+}
+
+// 日志附带链路ID
+func (ctx *Context) Debugf(format string, v ...interface{}) {
+	ctx.output(log.LvDebug, fmt.Sprintf(format, v...))
+}
+
+func (ctx *Context) Infof(format string, v ...interface{}) {
+	ctx.output(log.LvInfo, fmt.Sprintf(format, v...))
+}
+
+func (ctx *Context) Warnf(format string, v ...interface{}) {
+	ctx.output(log.LvWarn, fmt.Sprintf(format, v...))
+}
+
+func (ctx *Context) Errorf(format string, v ...interface{}) {
+	ctx.output(log.LvError, fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrace(t *testing.T) {
+	enableTrace = true
+	path := filepath.Join(t.TempDir(), "span.log")
+	if err := openSpanSink(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		defaultSpanSink.Load().(*spanSink).f.Close()
+		defaultSpanSink.Store((*spanSink)(nil))
+		enableTrace = false
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := NewNode(), NewNode()
+	go (&Server{Node: server}).Serve(l)
+	client.SetRouterAddr(l.Addr().String())
+
+	recv := make(chan *Context, 1)
+	NodeOnWithoutQueue(server, "TestTrace", func(ctx *Context, args *testCodecArgs) { recv <- ctx })
+
+	ctx := &Context{node: client}
+	ctx.StartTrace()
+	ctx.Route("router", "TestTrace", &testCodecArgs{})
+	select {
+	case ctx2 := <-recv:
+		if ctx2.TraceId != ctx.TraceId || ctx2.ParentSpanId != ctx.SpanId || ctx2.SpanId == ctx.SpanId {
+			t.Error("trace not propagated", ctx.TraceId, ctx2.TraceId, ctx2.ParentSpanId)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait trace message timeout")
+	}
+
+	// 处理完成后记录
+	time.Sleep(50 * time.Millisecond)
+	f, _ := os.Open(path)
+	defer f.Close()
+	span := &Span{}
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Fatal("span not recorded")
+	}
+	json.Unmarshal(scanner.Bytes(), span)
+	if span.TraceId != ctx.TraceId || span.ParentId != ctx.SpanId || span.Name != "TestTrace" {
+		t.Error("invalid span", span)
+	}
+}
+
+func TestSessionTrace(t *testing.T) {
+	enableTrace = true
+	defer func() { enableTrace = false }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := NewNode(), NewNode()
+	go (&Server{Node: server}).Serve(l)
+	client.SetRouterAddr(l.Addr().String())
+
+	recv := make(chan *Context, 1)
+	NodeOnWithoutQueue(server, "TestSessionTrace", func(ctx *Context, args *testCodecArgs) { recv <- ctx })
+
+	// 网关创建链路后，会话转发的消息透传链路
+	ctx := &Context{}
+	ctx.StartTrace()
+	ss := &Session{Id: "test_trace", node: client}
+	ss.SetTrace(ctx)
+	if err := ss.Route("router", "TestSessionTrace", &testCodecArgs{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ctx2 := <-recv:
+		if ctx2.TraceId != ctx.TraceId || ctx2.ParentSpanId != ctx.SpanId || ctx2.Ssid != ss.Id {
+			t.Error("session trace not propagated", ctx.TraceId, ctx2.TraceId, ctx2.ParentSpanId)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait trace message timeout")
+	}
+}
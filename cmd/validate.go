@@ -0,0 +1,238 @@
+package cmd
+
+// 2021-10-04 消息参数校验。注册时解析结构体的validate标签
+// 解析参数后、调用中间件及处理函数前校验，失败时回复错误
+// 支持required、min、max、len、oneof、regex，regex需放在最后
+// 如：Name string `validate:"required,max=16,regex=^\w+$"`
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type fieldRule struct {
+	required bool
+	min, max *float64
+	len_     *int
+	oneof    []string
+	regex    *regexp.Regexp
+}
+
+type fieldEntry struct {
+	index  int
+	name   string
+	rule   *fieldRule
+	nested *structRules // 嵌套的结构体
+}
+
+type structRules struct {
+	fields []fieldEntry
+}
+
+// 解析参数类型的校验规则，无规则时返回nil。标签无效时panic
+func compileRules(type_ reflect.Type) *structRules {
+	return compileStructRules(type_, map[reflect.Type]bool{})
+}
+
+func compileStructRules(type_ reflect.Type, visited map[reflect.Type]bool) *structRules {
+	for type_.Kind() == reflect.Ptr {
+		type_ = type_.Elem()
+	}
+	if type_.Kind() != reflect.Struct || visited[type_] {
+		return nil
+	}
+	visited[type_] = true
+	defer delete(visited, type_)
+
+	var rules structRules
+	for i := 0; i < type_.NumField(); i++ {
+		field := type_.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		entry := fieldEntry{index: i, name: field.Name}
+		if tag := field.Tag.Get("validate"); tag != "" {
+			entry.rule = parseFieldRule(type_, field, tag)
+		}
+		entry.nested = compileStructRules(field.Type, visited)
+		if entry.rule != nil || entry.nested != nil {
+			rules.fields = append(rules.fields, entry)
+		}
+	}
+	if len(rules.fields) == 0 {
+		return nil
+	}
+	return &rules
+}
+
+func parseFieldRule(type_ reflect.Type, field reflect.StructField, tag string) *fieldRule {
+	rule := &fieldRule{}
+	kind := indirectType(field.Type).Kind()
+	isNumber := kind >= reflect.Int && kind <= reflect.Float64
+	hasLen := kind == reflect.String || kind == reflect.Slice || kind == reflect.Map || kind == reflect.Array
+	invalid := func(format string, v ...interface{}) {
+		panic(fmt.Sprintf("%v.%s invalid validate tag: %s", type_, field.Name, fmt.Sprintf(format, v...)))
+	}
+	parseFloat := func(s string) *float64 {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			invalid("%s", err)
+		}
+		return &f
+	}
+
+	for tag != "" {
+		var item string
+		// 正则表达式可能包含逗号，取剩余部分
+		if strings.HasPrefix(tag, "regex=") {
+			item, tag = tag, ""
+		} else if k := strings.IndexByte(tag, ','); k >= 0 {
+			item, tag = tag[:k], tag[k+1:]
+		} else {
+			item, tag = tag, ""
+		}
+
+		key, value := item, ""
+		if k := strings.IndexByte(item, '='); k >= 0 {
+			key, value = item[:k], item[k+1:]
+		}
+		switch key {
+		case "required":
+			rule.required = true
+		case "min", "max":
+			if !isNumber && !hasLen {
+				invalid("%s on %v", key, field.Type)
+			}
+			if key == "min" {
+				rule.min = parseFloat(value)
+			} else {
+				rule.max = parseFloat(value)
+			}
+		case "len":
+			if !hasLen {
+				invalid("len on %v", field.Type)
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				invalid("%s", err)
+			}
+			rule.len_ = &n
+		case "oneof":
+			rule.oneof = strings.Fields(value)
+			if len(rule.oneof) == 0 {
+				invalid("empty oneof")
+			}
+		case "regex":
+			if kind != reflect.String {
+				invalid("regex on %v", field.Type)
+			}
+			rule.regex = regexp.MustCompile(value)
+		default:
+			invalid("unknown rule %q", key)
+		}
+	}
+	return rule
+}
+
+func indirectType(type_ reflect.Type) reflect.Type {
+	for type_.Kind() == reflect.Ptr {
+		type_ = type_.Elem()
+	}
+	return type_
+}
+
+func (rules *structRules) validate(v reflect.Value) error {
+	return rules.validatePath(v, "")
+}
+
+func (rules *structRules) validatePath(v reflect.Value, prefix string) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	for _, entry := range rules.fields {
+		fv := v.Field(entry.index)
+		name := prefix + entry.name
+		if entry.rule != nil {
+			if err := entry.rule.check(fv); err != nil {
+				return fmt.Errorf("%s %v", name, err)
+			}
+		}
+		if entry.nested != nil {
+			if err := entry.nested.validatePath(fv, name+"."); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (rule *fieldRule) check(v reflect.Value) error {
+	if rule.required && v.IsZero() {
+		return errors.New("is required")
+	}
+	for v.Kind() == reflect.Ptr {
+		// 可选参数未填写
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	var n float64
+	var isNumber bool
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, isNumber = float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, isNumber = float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		n, isNumber = v.Float(), true
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		// 字符串按字符计算长度
+		if v.Kind() == reflect.String {
+			n = float64(len([]rune(v.String())))
+		} else {
+			n = float64(v.Len())
+		}
+		if rule.len_ != nil && int(n) != *rule.len_ {
+			return fmt.Errorf("length must be %d", *rule.len_)
+		}
+	}
+	if rule.min != nil && n < *rule.min {
+		if isNumber {
+			return fmt.Errorf("must be at least %v", *rule.min)
+		}
+		return fmt.Errorf("length must be at least %v", *rule.min)
+	}
+	if rule.max != nil && n > *rule.max {
+		if isNumber {
+			return fmt.Errorf("must be at most %v", *rule.max)
+		}
+		return fmt.Errorf("length must be at most %v", *rule.max)
+	}
+
+	if len(rule.oneof) > 0 {
+		s := fmt.Sprint(v.Interface())
+		var ok bool
+		for _, option := range rule.oneof {
+			if s == option {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("must be one of %s", strings.Join(rule.oneof, " "))
+		}
+	}
+	if rule.regex != nil && !rule.regex.MatchString(v.String()) {
+		return fmt.Errorf("does not match %s", rule.regex)
+	}
+	return nil
+}
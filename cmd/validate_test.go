@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testValidateItem struct {
+	Id int `validate:"min=1"`
+}
+
+type testValidateArgs struct {
+	Name  string   `validate:"required,max=4,regex=^[a-z,]+$"`
+	Level int      `validate:"min=1,max=100"`
+	Code  string   `validate:"len=3"`
+	Mode  string   `validate:"oneof=easy hard"`
+	Tags  []string `validate:"max=2"`
+	Ptr   *int     `validate:"min=0"`
+	Item  *testValidateItem
+}
+
+func TestValidate(t *testing.T) {
+	rules := compileRules(reflect.TypeOf((*testValidateArgs)(nil)))
+	valid := testValidateArgs{Name: "a,b", Level: 1, Code: "abc", Mode: "easy"}
+	if err := rules.validate(reflect.ValueOf(&valid)); err != nil {
+		t.Error("valid args", err)
+	}
+
+	neg := -1
+	for _, args := range []testValidateArgs{
+		{Level: 1, Code: "abc", Mode: "easy"},
+		{Name: "abcde", Level: 1, Code: "abc", Mode: "easy"},
+		{Name: "A", Level: 1, Code: "abc", Mode: "easy"},
+		{Name: "a", Level: 0, Code: "abc", Mode: "easy"},
+		{Name: "a", Level: 101, Code: "abc", Mode: "easy"},
+		{Name: "a", Level: 1, Code: "ab", Mode: "easy"},
+		{Name: "a", Level: 1, Code: "abc", Mode: "normal"},
+		{Name: "a", Level: 1, Code: "abc", Mode: "easy", Tags: []string{"x", "y", "z"}},
+		{Name: "a", Level: 1, Code: "abc", Mode: "easy", Ptr: &neg},
+		{Name: "a", Level: 1, Code: "abc", Mode: "easy", Item: &testValidateItem{}},
+	} {
+		if err := rules.validate(reflect.ValueOf(&args)); err == nil {
+			t.Errorf("invalid args %+v", args)
+		}
+	}
+	if compileRules(reflect.TypeOf((*testCodecArgs)(nil))) != nil {
+		t.Error("rules without tag")
+	}
+}
+
+func TestValidateInvalidTag(t *testing.T) {
+	type badArgs struct {
+		N bool `validate:"min=1"`
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("compile invalid tag")
+		}
+	}()
+	compileRules(reflect.TypeOf((*badArgs)(nil)))
+}
+
+func TestHandleValidate(t *testing.T) {
+	node := NewNode()
+	var calls int
+	node.Use(func(next Handler) Handler {
+		return func(ctx *Context, args interface{}) {
+			calls++
+			next(ctx, args)
+		}
+	})
+	NodeOnWithoutQueue(node, "TestValidate", func(ctx *Context, args *testValidateItem) {})
+
+	rc := NewRecordConn()
+	if err := node.Handle(&Context{Out: rc}, "TestValidate", []byte(`{"Id":0}`)); err == nil {
+		t.Error("handle invalid args")
+	}
+	node.Handle(&Context{Out: rc}, "TestValidate", []byte(`{"Id":1}`))
+	if calls != 1 {
+		t.Error("middleware calls", calls)
+	}
+
+	pkgs := rc.Packages()
+	if len(pkgs) != 1 || pkgs[0].Code != CodeBadRequest {
+		t.Error("validate reply", pkgs)
+	}
+	if list := node.Metrics(); len(list) != 1 || list[0].Invalid != 1 || list[0].Calls != 1 {
+		t.Error("validate metrics", list)
+	}
+}
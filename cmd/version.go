@@ -0,0 +1,96 @@
+package cmd
+
+// 2021-10-08 协议版本。同一消息可按版本范围注册多个处理函数
+// 网关握手时协商版本，经Package.Version透传到服务
+// 优先匹配版本范围，其次未指定版本的处理函数，最后选择最接近的版本
+
+import (
+	"fmt"
+	"sort"
+)
+
+const CodeVersionTooLow = 426 // 客户端版本过低
+
+// 注册版本范围[minVersion, maxVersion]的处理函数，maxVersion为0时不限
+func (s *CmdSet) BindVersion(name string, minVersion, maxVersion int, h Handler, i interface{}, isPushQueue bool) {
+	if minVersion < 0 || (maxVersion > 0 && maxVersion < minVersion) {
+		panic(fmt.Sprintf("cmd %s bind invalid version [%d, %d]", name, minVersion, maxVersion))
+	}
+	e := newCmdEntry(name, h, i, isPushQueue)
+	e.minVersion, e.maxVersion = minVersion, maxVersion
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.versions == nil {
+		s.versions = map[string][]*cmdEntry{}
+	}
+	for _, other := range s.versions[name] {
+		if other.overlap(e) {
+			panic(fmt.Sprintf("cmd %s version [%d, %d] overlaps [%d, %d]", name, minVersion, maxVersion, other.minVersion, other.maxVersion))
+		}
+	}
+	e.chained = s.chain(name, e.h)
+	list := append(s.versions[name], e)
+	sort.Slice(list, func(i, j int) bool { return list[i].minVersion < list[j].minVersion })
+	s.versions[name] = list
+}
+
+func (e *cmdEntry) overlap(other *cmdEntry) bool {
+	return (e.maxVersion == 0 || other.minVersion <= e.maxVersion) &&
+		(other.maxVersion == 0 || e.minVersion <= other.maxVersion)
+}
+
+// 与版本的距离，在范围内时为0
+func (e *cmdEntry) distance(version int) int {
+	if version < e.minVersion {
+		return e.minVersion - version
+	}
+	if e.maxVersion > 0 && version > e.maxVersion {
+		return version - e.maxVersion
+	}
+	return 0
+}
+
+// 需持有s.mu
+func (s *CmdSet) lookupLocked(name string, version int) *cmdEntry {
+	list := s.versions[name]
+	var nearest *cmdEntry
+	for _, e := range list {
+		// 距离相同时选择较低的版本
+		if nearest == nil || e.distance(version) < nearest.distance(version) {
+			nearest = e
+		}
+	}
+	if nearest != nil && nearest.distance(version) == 0 {
+		return nearest
+	}
+	if e, ok := s.e[name]; ok {
+		return e
+	}
+	return nearest
+}
+
+func (node *Node) BindVersion(name string, minVersion, maxVersion int, h Handler, args interface{}) {
+	node.cmdSet.BindVersion(name, minVersion, maxVersion, h, args, true)
+}
+
+func BindVersion(name string, minVersion, maxVersion int, h Handler, args interface{}) {
+	DefaultNode().BindVersion(name, minVersion, maxVersion, h, args)
+}
+
+// 按版本范围注册消息，消息入队处理
+func OnVersion[T any](name string, minVersion, maxVersion int, h func(*Context, *T)) {
+	NodeOnVersion(DefaultNode(), name, minVersion, maxVersion, h)
+}
+
+func NodeOnVersion[T any](node *Node, name string, minVersion, maxVersion int, h func(*Context, *T)) {
+	node.cmdSet.BindVersion(name, minVersion, maxVersion, typedHandler(h), (*T)(nil), true)
+}
+
+// 协商的版本，客户端版本高于服务支持的最高版本时使用最高版本
+func NegotiateVersion(clientVersion, maxVersion int) int {
+	if maxVersion > 0 && clientVersion > maxVersion {
+		return maxVersion
+	}
+	return clientVersion
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import "testing"
+
+func TestBindVersion(t *testing.T) {
+	node := NewNode()
+	var handled string
+	bind := func(name string) Handler {
+		return func(ctx *Context, args interface{}) { handled = name }
+	}
+	node.BindWithoutQueue("TestVersion", bind("default"), (*testCodecArgs)(nil))
+	node.cmdSet.BindVersion("TestVersion", 2, 3, bind("v2"), (*testCodecArgs)(nil), false)
+	node.cmdSet.BindVersion("TestVersion", 5, 0, bind("v5"), (*testCodecArgs)(nil), false)
+	node.cmdSet.BindVersion("TestVersionOnly", 2, 3, bind("only_v2"), (*testCodecArgs)(nil), false)
+	node.cmdSet.BindVersion("TestVersionOnly", 6, 7, bind("only_v6"), (*testCodecArgs)(nil), false)
+
+	for _, sample := range []struct {
+		name    string
+		version int
+		handled string
+	}{
+		{"TestVersion", 0, "default"},
+		{"TestVersion", 2, "v2"},
+		{"TestVersion", 3, "v2"},
+		{"TestVersion", 4, "default"},
+		{"TestVersion", 9, "v5"},
+		{"TestVersionOnly", 1, "only_v2"},
+		{"TestVersionOnly", 4, "only_v2"},
+		{"TestVersionOnly", 5, "only_v6"},
+		{"TestVersionOnly", 9, "only_v6"},
+	} {
+		handled = ""
+		node.Handle(&Context{Version: sample.version}, sample.name, nil)
+		if handled != sample.handled {
+			t.Errorf("%s version %d handled by %s, expect %s", sample.name, sample.version, handled, sample.handled)
+		}
+	}
+}
+
+func TestBindVersionOverlap(t *testing.T) {
+	node := NewNode()
+	node.BindVersion("TestOverlap", 2, 0, func(ctx *Context, args interface{}) {}, (*testCodecArgs)(nil))
+	defer func() {
+		if recover() == nil {
+			t.Error("bind overlapped version")
+		}
+	}()
+	node.BindVersion("TestOverlap", 1, 4, func(ctx *Context, args interface{}) {}, (*testCodecArgs)(nil))
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	if v := NegotiateVersion(5, 3); v != 3 {
+		t.Error("negotiate higher version", v)
+	}
+	if v := NegotiateVersion(2, 3); v != 2 {
+		t.Error("negotiate lower version", v)
+	}
+	if v := NegotiateVersion(5, 0); v != 5 {
+		t.Error("negotiate unlimited version", v)
+	}
+}
@@ -0,0 +1,88 @@
+package cmd
+
+// 2021-08-28 可选的并行处理模式。消息按分片KEY分配到固定的协程
+// 相同KEY的消息保持顺序，不同KEY并行处理。未开启时仍由RunOnce单线程处理
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+const workerQueueSize = 4 << 10
+
+// 消息参数实现该接口且返回值非空时，使用返回值作为分片KEY，否则使用Context.Ssid
+type ShardKeyer interface {
+	ShardKey() string
+}
+
+type workerPool struct {
+	queues []chan *Message
+	wg     sync.WaitGroup
+}
+
+func newWorkerPool(node *Node, n int) *workerPool {
+	p := &workerPool{queues: make([]chan *Message, n)}
+	for i := range p.queues {
+		q := make(chan *Message, workerQueueSize)
+		p.queues[i] = q
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for msg := range q {
+				node.runMessage(msg)
+			}
+		}()
+	}
+	return p
+}
+
+func (p *workerPool) push(key string, msg *Message) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	p.queues[h.Sum32()%uint32(len(p.queues))] <- msg
+}
+
+// 处理完剩余消息后退出
+func (p *workerPool) close() {
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+}
+
+func shardKey(msg *Message) string {
+	if k, ok := msg.args.(ShardKeyer); ok && k.ShardKey() != "" {
+		return k.ShardKey()
+	}
+	return msg.ctx.Ssid
+}
+
+// 开启并行处理，n为协程数。n<=0时恢复单线程处理
+// 需在处理消息前设置
+func (node *Node) SetWorkers(n int) {
+	node.workerMu.Lock()
+	old := node.workers
+	node.workers = nil
+	if n > 0 {
+		node.workers = newWorkerPool(node, n)
+	}
+	node.workerMu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+}
+
+// 消息入队。无分片KEY的消息仍由RunOnce处理
+func (node *Node) dispatch(msg *Message) {
+	node.workerMu.RLock()
+	defer node.workerMu.RUnlock()
+	if node.workers != nil {
+		if key := shardKey(msg); key != "" {
+			node.workers.push(key, msg)
+			return
+		}
+	}
+	node.queue.Enqueue(msg)
+}
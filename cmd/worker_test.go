@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+type testShardArgs struct {
+	Key string
+	N   int
+}
+
+func (args *testShardArgs) ShardKey() string {
+	return args.Key
+}
+
+func TestWorkers(t *testing.T) {
+	node := NewNode()
+	node.SetWorkers(4)
+
+	var mu sync.Mutex
+	seqs := map[string][]int{}
+	node.BindWithName("TestWorker", func(ctx *Context, data interface{}) {
+		args := data.(*testShardArgs)
+		key := ctx.Ssid + args.Key
+
+		mu.Lock()
+		defer mu.Unlock()
+		seqs[key] = append(seqs[key], args.N)
+	}, (*testShardArgs)(nil))
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		for _, ssid := range []string{"s1", "s2", "s3"} {
+			data := []byte(`{"N":` + strconv.Itoa(i) + `}`)
+			if err := node.Handle(&Context{Ssid: ssid}, "TestWorker", data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data := []byte(`{"Key":"k1","N":` + strconv.Itoa(i) + `}`)
+		node.Handle(&Context{}, "TestWorker", data)
+	}
+	// 无分片KEY的消息由RunOnce处理
+	node.Handle(&Context{}, "TestWorker", []byte(`{"N":-1}`))
+	node.SetWorkers(0)
+	if len(seqs[""]) != 0 {
+		t.Error("handle message without shard key in workers")
+	}
+	node.waitAndRunOnce(8, 0)
+
+	for _, key := range []string{"s1", "s2", "s3", "k1"} {
+		seq := seqs[key]
+		if len(seq) != n {
+			t.Fatal("lost message", key, len(seq))
+		}
+		for i := range seq {
+			if seq[i] != i {
+				t.Fatal("message out of order", key, seq)
+			}
+		}
+	}
+	if len(seqs[""]) != 1 {
+		t.Error("handle message without shard key", seqs[""])
+	}
+}
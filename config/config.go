@@ -44,16 +44,86 @@ type server struct {
 	Addr string `xml:"Address"`
 }
 
+// 服务内部连接TLS证书配置
+type tlsConfig struct {
+	CertFile     string // 证书，同时用于服务端与客户端
+	KeyFile      string
+	CAFile       string // 集群CA证书
+	ServerName   string // 校验服务端证书的名称，默认为连接的主机名
+	VerifyClient bool   // 服务端校验客户端证书
+}
+
+// 链路追踪配置
+type traceConfig struct {
+	Enable   bool   // 网关为客户端消息创建链路
+	SpanFile string // 消息处理耗时的输出文件，为空时不输出
+}
+
+// HMAC签名密钥
+type signKey struct {
+	Id  string
+	Key string
+}
+
+// 目标服务重连期间缓存消息及熔断
+type routeBuffer struct {
+	TTL             int // 缓存消息的有效毫秒数，默认10000
+	Size            int // 缓存消息的最大数量，默认1024
+	BreakerFailures int // 连续连接失败的次数达到后熔断，默认5
+}
+
+// 服务内部连接池
+type clientPool struct {
+	Server string `xml:",attr"` // 目标服务，为空时为默认配置
+	Size   int    // 连接数，默认1
+	Select string // 选择连接的方式，hash|round_robin，默认hash按会话保持顺序
+}
+
+// 网关的客户端协议版本
+type gatewayConfig struct {
+	MinVersion int // 拒绝低于该版本的客户端
+	MaxVersion int // 支持的最高版本，0表示不限
+}
+
+// 消息录制，用于回放复现问题
+type recordConfig struct {
+	File       string // 录制文件，为空时不录制
+	MaxSize    int    // 单个文件的最大MB，默认100
+	MaxBackups int    // 轮转后保留的文件数，默认5
+}
+
+// 发送队列满时的处理策略
+type backpressure struct {
+	Type    string `xml:",attr"` // 连接类型，tcp|ws
+	Policy  string // block|drop_oldest|drop_newest|disconnect
+	Timeout int    // block等待的毫秒数，0表示一直等待
+}
+
 type Env struct {
 	path string
 
-	Sign            string
-	ProductKey      string
-	ServerList      []server `xml:"ServerList>Server"`
-	CompressPackage int
-	LogPath         string `xml:"Log>Path"`
-	LogTag          string `xml:"Log>Tag"`
-	EnableDebug     bool   // 开启调试，将输出消息统计日志等
+	Sign             string
+	ProductKey       string
+	SignMode         string    // 签名方式，md5|hmac，默认md5
+	SignKeys         []signKey `xml:"SignKeys>SignKey"`       // hmac服务器内部数据校验KEY，第一个用于签名
+	ProductKeys      []signKey `xml:"ProductKeys>ProductKey"` // hmac客户端与服务器数据校验KEY，第一个用于签名
+	ServerList       []server  `xml:"ServerList>Server"`
+	CompressPackage  int
+	LogPath          string `xml:"Log>Path"`
+	LogTag           string `xml:"Log>Tag"`
+	EnableDebug      bool   // 开启调试，将输出消息统计日志等
+	EnablePanicReply bool   // 消息处理异常时回复ServerError
+	Workers          int    // 大于0时消息按会话分配到多个协程并行处理，默认单线程
+	Trace            traceConfig
+	Codec            string // 服务内部连接的消息编码，json|binary，默认json
+	Compress         string // 服务内部连接请求的压缩算法，按优先级以逗号分隔，如snappy,gzip，默认不压缩
+	MaxMessageSize   int    // 服务内部单个消息最大长度，超过单帧时分片发送，默认4M
+	TLS              tlsConfig
+	Backpressures    []backpressure `xml:"Backpressures>Backpressure"`
+	ClientPools      []clientPool   `xml:"ClientPools>ClientPool"`
+	RouteBuffer      routeBuffer
+	Gateway          gatewayConfig
+	Record           recordConfig
 }
 
 func (env *Env) Path() string {
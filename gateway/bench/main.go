@@ -0,0 +1,194 @@
+package main
+
+// 压测网关，模拟多个机器人循环执行脚本
+// 脚本为JSON数组，如：
+// [{"Send":"hall.Login","Data":{"UId":"{bot}"},"Wait":"Login"},{"Sleep":1000}]
+// 数据中的"{bot}"替换为机器人编号，字符串中的{bot}替换为编号文本
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/guogeer/quasar/gateway/client"
+	"github.com/guogeer/quasar/log"
+)
+
+var (
+	url      = flag.String("url", "ws://127.0.0.1:8201/ws", "gateway websocket url")
+	bots     = flag.Int("n", 10, "number of bots")
+	script   = flag.String("script", "bench.json", "script file")
+	duration = flag.Duration("duration", time.Minute, "bench duration")
+	rampUp   = flag.Duration("rampup", 10*time.Millisecond, "interval between bots starting")
+	timeout  = flag.Duration("timeout", 5*time.Second, "wait reply timeout")
+	compress = flag.String("compress", "", "compression, e.g. snappy,gzip")
+	version  = flag.Int("ver", 0, "client protocol version")
+)
+
+type step struct {
+	Send  string          // 发送的消息
+	Data  json.RawMessage // 发送的数据
+	Wait  string          // 等待回复的消息，为空时不等待
+	Sleep int             // 执行前等待的毫秒数
+}
+
+type stepStats struct {
+	calls, errors int
+	latencies     []time.Duration
+}
+
+type stats struct {
+	mu          sync.Mutex
+	steps       map[string]*stepStats
+	dialErrors  int
+	disconnects int
+}
+
+func (s *stats) add(name string, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.steps[name]
+	if !ok {
+		st = &stepStats{}
+		s.steps[name] = st
+	}
+	st.calls++
+	if err != nil {
+		st.errors++
+		return
+	}
+	st.latencies = append(st.latencies, d)
+}
+
+func percentile(list []time.Duration, p float64) time.Duration {
+	if len(list) == 0 {
+		return 0
+	}
+	return list[int(float64(len(list)-1)*p)]
+}
+
+func (s *stats) report(elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.steps))
+	for name := range s.steps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("bots %d, elapsed %v, dial errors %d, disconnects %d\n", *bots, elapsed.Round(time.Millisecond), s.dialErrors, s.disconnects)
+	fmt.Printf("%-24s %8s %8s %8s %10s %10s %10s %10s\n", "message", "calls", "errors", "qps", "p50", "p90", "p99", "max")
+	for _, name := range names {
+		st := s.steps[name]
+		sort.Slice(st.latencies, func(i, j int) bool { return st.latencies[i] < st.latencies[j] })
+		fmt.Printf("%-24s %8d %8d %8.1f %10v %10v %10v %10v\n", name, st.calls, st.errors,
+			float64(st.calls)/elapsed.Seconds(),
+			percentile(st.latencies, 0.5).Round(time.Microsecond),
+			percentile(st.latencies, 0.9).Round(time.Microsecond),
+			percentile(st.latencies, 0.99).Round(time.Microsecond),
+			percentile(st.latencies, 1).Round(time.Microsecond))
+	}
+}
+
+func runBot(ctx context.Context, id int, steps []step, s *stats) {
+	opts := &client.Options{Version: *version, Compress: *compress}
+	c, err := client.Dial(ctx, *url, opts)
+	if err != nil {
+		s.mu.Lock()
+		s.dialErrors++
+		s.mu.Unlock()
+		log.Debugf("bot %d dial %v", id, err)
+		return
+	}
+	defer c.Close()
+
+	bot := strconv.Itoa(id)
+	botReplacer := strings.NewReplacer(`"{bot}"`, bot, "{bot}", bot)
+	for ctx.Err() == nil {
+		for _, st := range steps {
+			if st.Sleep > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Duration(st.Sleep) * time.Millisecond):
+				}
+			}
+			if st.Send == "" {
+				continue
+			}
+
+			data := json.RawMessage(botReplacer.Replace(string(st.Data)))
+			if len(data) == 0 {
+				data = json.RawMessage("{}")
+			}
+			start := time.Now()
+			if st.Wait == "" {
+				err = c.Send(st.Send, data)
+			} else {
+				reqCtx, cancel := context.WithTimeout(ctx, *timeout)
+				err = c.Request(reqCtx, st.Send, data, st.Wait, nil)
+				cancel()
+			}
+			// 压测结束时未完成的请求不统计
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Debugf("bot %d %s %v", id, st.Send, err)
+			}
+			s.add(st.Send, time.Since(start), err)
+
+			select {
+			case <-c.Done():
+				s.mu.Lock()
+				s.disconnects++
+				s.mu.Unlock()
+				log.Debugf("bot %d disconnect %v", id, c.Err())
+				return
+			default:
+			}
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	buf, err := os.ReadFile(*script)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var steps []step
+	if err := json.Unmarshal(buf, &steps); err != nil {
+		log.Fatalf("parse script %v", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancel()
+	ctx, cancel2 := context.WithTimeout(ctx, *duration)
+	defer cancel2()
+
+	s := &stats{steps: map[string]*stepStats{}}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *bots && ctx.Err() == nil; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			runBot(ctx, id, steps, s)
+		}(i)
+		time.Sleep(*rampUp)
+	}
+	wg.Wait()
+	s.report(time.Since(start))
+}
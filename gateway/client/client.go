@@ -0,0 +1,386 @@
+package client
+
+// 2021-10-24 网关客户端，与gateway.serveWs对应
+// 消息签名与cmd.Encode一致，握手时协商版本及压缩
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/guogeer/quasar/cmd"
+	"github.com/guogeer/quasar/log"
+)
+
+const (
+	writeWait      = 10 * time.Second
+	maxMessageSize = 4 << 20
+)
+
+var ErrClosed = errors.New("client closed")
+
+type Options struct {
+	Version   int    // 客户端支持的最高协议版本
+	Compress  string // 支持的压缩算法，多个以逗号分隔，为空时不压缩
+	Threshold int    // 压缩阈值，0时使用网关的默认值
+	Header    http.Header
+}
+
+// 网关回复的错误
+type ErrorReply struct {
+	MsgId string
+	Code  int
+	Err   string
+}
+
+type waiter struct {
+	name    string // 等待的消息ID
+	reqName string // 匹配错误回复的请求消息ID
+	ch      chan *cmd.Package
+}
+
+type Client struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+
+	version    int
+	compressor *cmd.Compressor
+	threshold  int
+
+	mu       sync.Mutex
+	handlers map[string]func(*cmd.Package)
+	onError  func(name string, err error)
+	waiters  []*waiter
+	requests map[string]chan struct{} // 等待同一回复的请求依次发送
+	err      error
+	done     chan struct{}
+}
+
+// 连接网关，地址如ws://127.0.0.1:8201/ws
+func Dial(ctx context.Context, rawURL string, opts *Options) (*Client, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	if opts.Version > 0 {
+		query.Set("ver", strconv.Itoa(opts.Version))
+	}
+	if opts.Compress != "" {
+		query.Set("compress", opts.Compress)
+	}
+	if opts.Threshold > 0 {
+		query.Set("threshold", strconv.Itoa(opts.Threshold))
+	}
+	u.RawQuery = query.Encode()
+
+	ws, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), opts.Header)
+	if err != nil {
+		return nil, err
+	}
+	ws.SetReadLimit(maxMessageSize)
+
+	c := &Client{
+		ws:       ws,
+		handlers: map[string]func(*cmd.Package){},
+		requests: map[string]chan struct{}{},
+		done:     make(chan struct{}),
+	}
+	// 网关协商的结果，响应头与网关一致
+	c.version, _ = strconv.Atoi(resp.Header.Get("X-Protocol-Version"))
+	if c.compressor = cmd.GetCompressor(resp.Header.Get("X-Compression")); c.compressor != nil {
+		c.threshold, _ = strconv.Atoi(resp.Header.Get("X-Compress-Threshold"))
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// 协商的协议版本
+func (c *Client) Version() int {
+	return c.version
+}
+
+// 协商的压缩算法，未压缩时为空
+func (c *Client) Compression() string {
+	if c.compressor == nil {
+		return ""
+	}
+	return c.compressor.Name()
+}
+
+// 发送消息，name如hall.Login
+func (c *Client) Send(name string, i interface{}) error {
+	buf, err := cmd.Encode(name, i)
+	if err != nil {
+		return err
+	}
+	mt := websocket.TextMessage
+	if c.compressor != nil {
+		mt = websocket.BinaryMessage
+		if buf, err = cmd.EncodeFrame(c.compressor, c.threshold, buf); err != nil {
+			return err
+		}
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.ws.WriteMessage(mt, buf)
+}
+
+// 注册消息的处理函数，在读协程中调用
+func (c *Client) Handle(name string, h func(*cmd.Package)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[name] = h
+}
+
+// 注册消息，由处理函数推导参数类型。解析失败时不调用h，错误交给HandleError
+func On[T any](c *Client, name string, h func(*T)) {
+	c.Handle(name, func(pkg *cmd.Package) {
+		args := new(T)
+		if err := json.Unmarshal(pkg.Data, args); err != nil {
+			c.reportError(pkg.Id, err)
+			return
+		}
+		h(args)
+	})
+}
+
+// 注册消息解析失败的处理函数，未注册时输出日志
+func (c *Client) HandleError(h func(name string, err error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onError = h
+}
+
+func (c *Client) reportError(name string, err error) {
+	c.mu.Lock()
+	h := c.onError
+	c.mu.Unlock()
+	if h == nil {
+		log.Warnf("decode message %s error %v", name, err)
+		return
+	}
+	h(name, err)
+}
+
+// 等待指定的消息。收到该消息的错误回复时返回*cmd.Error
+func (c *Client) Wait(ctx context.Context, name string) (*cmd.Package, error) {
+	return c.wait(ctx, c.addWaiter(name, name))
+}
+
+// 发送消息并等待回复，out不为空时解析回复的数据
+// 回复按消息ID匹配，同一回复的并发请求依次发送
+func (c *Client) Request(ctx context.Context, name string, in interface{}, replyName string, out interface{}) error {
+	unlock, err := c.lockRequest(ctx, replyName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// 服务收到的消息ID不含服务名
+	reqName := name
+	if k := strings.LastIndexByte(name, '.'); k >= 0 {
+		reqName = name[k+1:]
+	}
+	// 发送前等待，避免错过回复
+	w := c.addWaiter(replyName, reqName)
+	if err := c.Send(name, in); err != nil {
+		c.removeWaiter(w)
+		return err
+	}
+	pkg, err := c.wait(ctx, w)
+	if err != nil {
+		return err
+	}
+	if out != nil {
+		return json.Unmarshal(pkg.Data, out)
+	}
+	return nil
+}
+
+func (c *Client) lockRequest(ctx context.Context, replyName string) (func(), error) {
+	c.mu.Lock()
+	ch, ok := c.requests[replyName]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		c.requests[replyName] = ch
+	}
+	c.mu.Unlock()
+
+	select {
+	case ch <- struct{}{}:
+		return func() { <-ch }, nil
+	case <-c.done:
+		return nil, c.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) addWaiter(name, reqName string) *waiter {
+	w := &waiter{name: name, reqName: reqName, ch: make(chan *cmd.Package, 1)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waiters = append(c.waiters, w)
+	return w
+}
+
+func (c *Client) wait(ctx context.Context, w *waiter) (*cmd.Package, error) {
+	defer c.removeWaiter(w)
+	select {
+	case pkg := <-w.ch:
+		if pkg.Id == cmd.ErrorReplyId {
+			reply := &ErrorReply{}
+			json.Unmarshal(pkg.Data, reply)
+			return nil, &cmd.Error{Code: reply.Code, Msg: reply.Err}
+		}
+		return pkg, nil
+	case <-c.done:
+		return nil, c.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) removeWaiter(w *waiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, w2 := range c.waiters {
+		if w2 == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// 连接关闭后返回原因
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// 连接关闭时关闭
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) Close() error {
+	return c.ws.Close()
+}
+
+func (c *Client) readLoop() {
+	var err, replyErr error
+	defer func() {
+		// 网关拒绝握手后断开，如版本过低
+		if replyErr != nil {
+			err = replyErr
+		}
+		c.ws.Close()
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		close(c.done)
+	}()
+
+	for {
+		var mt int
+		var buf []byte
+		if mt, buf, err = c.ws.ReadMessage(); err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				err = ErrClosed
+			}
+			return
+		}
+		if mt == websocket.BinaryMessage {
+			if buf, err = cmd.DecodeFrame(buf, maxMessageSize); err != nil {
+				return
+			}
+		}
+		var pkg *cmd.Package
+		if pkg, err = decodePackage(buf); err != nil {
+			return
+		}
+		if pkg.Id == cmd.ErrorReplyId && pkg.Code == cmd.CodeVersionTooLow {
+			replyErr = &cmd.Error{Code: pkg.Code, Msg: pkg.Err}
+		}
+		c.dispatch(pkg)
+	}
+}
+
+// 网关发送的消息使用默认的签名，与cmd.Encode一致
+func decodePackage(buf []byte) (*cmd.Package, error) {
+	pkg, err := cmd.Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+	if pkg.Data, err = unzipData(pkg.Data); err != nil {
+		return nil, err
+	}
+	return pkg, nil
+}
+
+// 文本帧的大数据zlib压缩后base64编码
+// base64及zlib头校验失败时为普通的字符串数据，原样返回
+func unzipData(data json.RawMessage) (json.RawMessage, error) {
+	var s string
+	if len(data) < 2 || data[0] != '"' || json.Unmarshal(data, &s) != nil {
+		return data, nil
+	}
+	zipData, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return data, nil
+	}
+	r, err := zlib.NewReader(bytes.NewReader(zipData))
+	if err != nil {
+		return data, nil
+	}
+	defer r.Close()
+	return io.ReadAll(io.LimitReader(r, maxMessageSize))
+}
+
+func (c *Client) dispatch(pkg *cmd.Package) {
+	// 错误回复按请求的消息ID匹配
+	var errMsgId string
+	if pkg.Id == cmd.ErrorReplyId {
+		reply := &ErrorReply{}
+		json.Unmarshal(pkg.Data, reply)
+		errMsgId = reply.MsgId
+	}
+
+	c.mu.Lock()
+	h := c.handlers[pkg.Id]
+	var matched []*waiter
+	for _, w := range c.waiters {
+		if w.name == pkg.Id || (errMsgId != "" && w.reqName == errMsgId) {
+			matched = append(matched, w)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, w := range matched {
+		select {
+		case w.ch <- pkg:
+		default:
+		}
+	}
+	if h != nil {
+		h(pkg)
+	}
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guogeer/quasar/cmd"
+	gateway "github.com/guogeer/quasar/gateway/internal"
+	"github.com/guogeer/quasar/log"
+)
+
+type testArgs struct {
+	N int
+	S string
+}
+
+func TestMain(m *testing.M) {
+	log.SetLevel("FATAL")
+	cmd.BindWithoutQueue("Echo", func(ctx *cmd.Context, data interface{}) {
+		ctx.Out.WriteJSON("Echo", data)
+	}, (*testArgs)(nil))
+	m.Run()
+}
+
+func TestClient(t *testing.T) {
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+	url := "ws" + srv.URL[4:] + "/ws"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	for _, compress := range []string{"", "gzip"} {
+		c, err := Dial(ctx, url, &Options{Compress: compress, Threshold: 64})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Compression() != compress {
+			t.Error("negotiate compression", c.Compression())
+		}
+
+		echo := make(chan *testArgs, 1)
+		On(c, "Echo", func(args *testArgs) { echo <- args })
+		in := &testArgs{N: 1, S: strings.Repeat("hello ", 32)}
+		out := &testArgs{}
+		if err := c.Request(ctx, "Echo", in, "Echo", out); err != nil {
+			t.Fatal(err)
+		}
+		if *out != *in || (<-echo).N != 1 {
+			t.Error("echo", out)
+		}
+
+		var e *cmd.Error
+		if err := c.Request(ctx, "Unknown", in, "Unknown", nil); !errors.As(err, &e) || e.Code != cmd.CodeUnknownMessage {
+			t.Error("request unknown message", err)
+		}
+		c.Close()
+	}
+}
+
+func TestClientVersion(t *testing.T) {
+	gateway.SetClientVersion(2, 3)
+	defer gateway.SetClientVersion(0, 0)
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+	url := "ws" + srv.URL[4:] + "/ws"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, url, &Options{Version: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Version() != 3 {
+		t.Error("negotiate version", c.Version())
+	}
+	c.Close()
+
+	c, err = Dial(ctx, url, &Options{Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-c.Done()
+	var e *cmd.Error
+	if !errors.As(c.Err(), &e) || e.Code != cmd.CodeVersionTooLow {
+		t.Error("reject low version", c.Err())
+	}
+}
+
+func TestDecodePackage(t *testing.T) {
+	b := bytes.Buffer{}
+	w := zlib.NewWriter(&b)
+	w.Write([]byte(`{"N":1}`))
+	w.Close()
+	zipData := `"` + base64.StdEncoding.EncodeToString(b.Bytes()) + `"`
+
+	samples := []struct {
+		data, want string
+	}{
+		{zipData, `{"N":1}`},
+		{`"hello"`, `"hello"`},       // 非base64
+		{`"SGVsbG8="`, `"SGVsbG8="`}, // 非zlib
+		{`{"N":2}`, `{"N":2}`},
+	}
+	for _, sample := range samples {
+		buf, _ := cmd.Encode("Test", json.RawMessage(sample.data))
+		pkg, err := decodePackage(buf)
+		if err != nil {
+			t.Fatal(sample.data, err)
+		}
+		if string(pkg.Data) != sample.want {
+			t.Error("decode package", sample.data, string(pkg.Data))
+		}
+	}
+}
+
+func TestDecodeInvalidSign(t *testing.T) {
+	buf, _ := json.Marshal(&cmd.Package{Id: "Test", Data: json.RawMessage(`{"N":1}`), Sign: "invalid"})
+	if _, err := decodePackage(buf); err != cmd.ErrInvalidSign {
+		t.Error("decode invalid sign", err)
+	}
+}
+
+func TestOnDecodeError(t *testing.T) {
+	c := &Client{handlers: map[string]func(*cmd.Package){}}
+	var called bool
+	On(c, "Test", func(args *testArgs) { called = true })
+	var errName string
+	c.HandleError(func(name string, err error) { errName = name })
+
+	c.dispatch(&cmd.Package{Id: "Test", Data: json.RawMessage(`"hello"`)})
+	if called || errName != "Test" {
+		t.Error("report decode error", called, errName)
+	}
+}
+
+func TestConcurrentRequest(t *testing.T) {
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+	url := "ws" + srv.URL[4:] + "/ws"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一回复的请求各自收到对应的回复
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func(n int) {
+			out := &testArgs{}
+			err := c.Request(ctx, "Echo", &testArgs{N: n}, "Echo", out)
+			if err == nil && out.N != n {
+				err = fmt.Errorf("request %d reply %d", n, out.N)
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	// 普通的错误回复不作为断开原因
+	if err := c.Request(ctx, "Unknown", nil, "Unknown", nil); err == nil {
+		t.Error("request unknown message")
+	}
+	c.Close()
+	<-c.Done()
+	var e *cmd.Error
+	if errors.As(c.Err(), &e) {
+		t.Error("close reason", c.Err())
+	}
+}
@@ -0,0 +1,38 @@
+package gateway
+
+// 2021-10-12 握手时协商二进制帧的压缩算法及阈值
+// 客户端通过URL参数compress上报支持的算法，多个以逗号分隔，threshold上报阈值
+// 协商成功后通过响应头返回，此后双方均使用二进制帧
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/guogeer/quasar/cmd"
+)
+
+const (
+	compressHeader  = "X-Compression"
+	thresholdHeader = "X-Compress-Threshold"
+)
+
+// 协商的压缩算法及阈值，客户端未请求时返回nil
+func negotiateCompress(r *http.Request, header http.Header) (*cmd.Compressor, int) {
+	accept := r.URL.Query().Get("compress")
+	if accept == "" {
+		accept = r.Header.Get(compressHeader)
+	}
+	c := cmd.NegotiateCompressor(accept)
+	if c == nil {
+		return nil, 0
+	}
+
+	// 未指定阈值时使用配置CompressPackage
+	threshold, _ := strconv.Atoi(r.URL.Query().Get("threshold"))
+	if threshold <= 0 {
+		threshold = cmd.DefaultCompressThreshold()
+	}
+	header.Set(compressHeader, c.Name())
+	header.Set(thresholdHeader, strconv.Itoa(threshold))
+	return c, threshold
+}
@@ -1,10 +1,13 @@
 package gateway
 
 import (
+	"context"
+	"net/http"
 	"sync"
 	"time"
 
 	"github.com/guogeer/quasar/cmd"
+	"github.com/guogeer/quasar/log"
 	"github.com/guogeer/quasar/util"
 )
 
@@ -91,3 +94,31 @@ func matchBestServer(ssid, name string) string {
 	}
 	return matchName
 }
+
+// 优雅关闭
+// 1、从路由注销，不再分配新的客户端
+// 2、停止接收新连接
+// 3、通知客户端ServerClose，剩余消息发送完成后断开
+func Shutdown(ctx context.Context, srv *http.Server, serverName string) error {
+	if err := cmd.UnregisterService(ctx); err != nil {
+		log.Warnf("unregister service %v", err)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		return err
+	}
+	for _, ss := range cmd.GetSessionList() {
+		ss.Out.WriteJSON("ServerClose", map[string]string{"ServerName": serverName})
+		ss.Out.Close()
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for cmd.GetSessionManage().Count() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -6,7 +6,11 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/guogeer/quasar/cmd"
@@ -102,3 +106,188 @@ func TestRecvClientPackage(t *testing.T) {
 		}
 	}
 }
+
+func TestClientVersion(t *testing.T) {
+	SetClientVersion(2, 5)
+	defer SetClientVersion(0, 0)
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+	url := "ws" + srv.URL[4:] + "/ws"
+
+	ws, resp, err := websocket.DefaultDialer.Dial(url+"?ver=9", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Close()
+	if ver := resp.Header.Get(versionHeader); ver != "5" {
+		t.Error("negotiate version", ver)
+	}
+
+	ws, _, err = websocket.DefaultDialer.Dial(url+"?ver=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	_, buf, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg, err := cmd.Decode(buf)
+	if err != nil || pkg.Id != cmd.ErrorReplyId || pkg.Code != cmd.CodeVersionTooLow {
+		t.Error("reject low version", pkg, err)
+	}
+}
+
+func TestCompressFrame(t *testing.T) {
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+	url := "ws" + srv.URL[4:] + "/ws?compress=br,gzip&threshold=64"
+
+	ws, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if resp.Header.Get(compressHeader) != "gzip" || resp.Header.Get(thresholdHeader) != "64" {
+		t.Fatal("negotiate compress", resp.Header)
+	}
+
+	args := &testArgs{N: 1, S: strings.Repeat("hello world ", 32)}
+	buf, _ := cmd.Encode("Echo", args)
+	frame, _ := cmd.EncodeFrame(cmd.GetCompressor("gzip"), 64, buf)
+	ws.WriteMessage(websocket.BinaryMessage, frame)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mt, frame, err := ws.ReadMessage()
+		if err != nil || mt != websocket.BinaryMessage || frame[0] == 0 {
+			t.Error("read compressed frame", mt, err)
+			return
+		}
+		buf, err := cmd.DecodeFrame(frame, 1<<20)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		pkg, err := cmd.Decode(buf)
+		if err != nil || pkg.Id != "Echo" || !util.EqualJSON(json.RawMessage(pkg.Data), args) {
+			t.Error("recv compressed echo", pkg, err)
+		}
+	}()
+
+	timeout := time.After(3 * time.Second)
+	for {
+		cmd.RunOnce()
+		select {
+		case <-done:
+			return
+		case <-timeout:
+			t.Fatal("wait echo timeout")
+		default:
+		}
+	}
+}
+
+func TestForwardServerError(t *testing.T) {
+	out := cmd.NewRecordConn()
+	cmd.AddSession(&cmd.Session{Id: "test_error", Out: out})
+	defer cmd.RemoveSession("test_error")
+
+	data := []byte(`{"MsgId":"Login","Code":400,"Err":"invalid"}`)
+	if err := cmd.Handle(&cmd.Context{Ssid: "test_error", Out: cmd.NewRecordConn()}, cmd.ErrorReplyId, data); err != nil {
+		t.Fatal(err)
+	}
+	pkgs := out.Packages()
+	if len(pkgs) != 1 || pkgs[0].Id != cmd.ErrorReplyId {
+		t.Fatal("forward server error", pkgs)
+	}
+	args := &errorArgs{}
+	if json.Unmarshal(pkgs[0].Data, args); args.MsgId != "Login" || args.Code != 400 {
+		t.Error("server error data", string(pkgs[0].Data))
+	}
+}
+
+func TestRecordClientMessage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "record.log")
+	if err := cmd.StartRecord(path, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	c := &WsConn{ssid: "test_record", send: cmd.NewSendQueue(1, cmd.GetBackpressure("ws"))}
+	c.WriteJSON("TestRecord", &testArgs{N: 1})
+	cmd.StopRecord()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var n int
+	cmd.ReadRecords(f, func(rec *cmd.Record) error {
+		if rec.Dir == cmd.RecordOut && rec.Id == "TestRecord" && rec.Ssid == "test_record" {
+			n++
+		}
+		return nil
+	})
+	if n != 1 {
+		t.Error("record client message", n)
+	}
+}
+
+// 网关、router及服务在同一进程，通过mem://连接
+func TestGatewayLoopback(t *testing.T) {
+	gw, router, hall := cmd.NewNode(), cmd.NewNode(), cmd.NewNode()
+	Bind(gw)
+	for _, srv := range []*cmd.Server{
+		{Addr: "mem://test_gw_router", Node: router},
+		{Addr: "mem://test_gw_hall", Node: hall},
+	} {
+		go srv.ListenAndServe()
+		defer srv.Shutdown(context.Background())
+	}
+	gw.SetRouterAddr("mem://test_gw_router")
+
+	type addrArgs struct{ ServerName, ServerAddr string }
+	cmd.NodeOnWithoutQueue(router, "C2S_GetServerAddr", func(ctx *cmd.Context, args *addrArgs) {
+		ctx.WriteJSON("S2C_GetServerAddr", addrArgs{ServerAddr: "mem://" + args.ServerName})
+	})
+	cmd.NodeOnWithoutQueue(hall, "Echo", func(ctx *cmd.Context, args *testArgs) {
+		ss := &cmd.Session{Id: ctx.Ssid, Out: ctx.Out}
+		ss.WriteJSON("FUNC_Route", map[string]interface{}{"Id": "Echo", "Data": args})
+	})
+
+	serverStateMu.Lock()
+	serverStates["test_gw_hall"] = &serverState{ServerName: "test_gw_hall"}
+	serverStateMu.Unlock()
+	defer func() {
+		serverStateMu.Lock()
+		delete(serverStates, "test_gw_hall")
+		serverStateMu.Unlock()
+	}()
+
+	srv := httptest.NewServer(NewHandler(gw))
+	defer srv.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+srv.URL[4:]+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	args := &testArgs{N: 2, S: "loopback"}
+	buf, _ := cmd.Encode("test_gw_hall.Echo", args)
+	ws.WriteMessage(websocket.TextMessage, buf)
+
+	ws.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, buf, err = ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg, err := cmd.Decode(buf)
+	if err != nil || pkg.Id != "Echo" || !util.EqualJSON(json.RawMessage(pkg.Data), args) {
+		t.Error("recv loopback echo", pkg, err)
+	}
+	if cmd.GetSession(pkg.Ssid) != nil || len(gw.GetSessionList()) != 1 {
+		t.Error("gateway session not in gateway node")
+	}
+}
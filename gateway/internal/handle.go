@@ -21,25 +21,38 @@ type Args struct {
 	Servers    []*serverState
 }
 
+// 服务回复的错误
+type errorArgs struct {
+	MsgId string
+	Code  int
+	Err   string
+}
+
 func init() {
-	cmd.BindWithoutQueue("FUNC_Route", FUNC_Route, (*Args)(nil))
+	Bind(cmd.DefaultNode())
+}
+
+// 注册网关的消息，与NewHandler使用同一节点
+func Bind(node *cmd.Node) {
+	node.BindWithoutQueue("FUNC_Route", FUNC_Route, (*Args)(nil))
+	node.BindWithoutQueue(cmd.ErrorReplyId, FUNC_ServerError, (*errorArgs)(nil))
 
-	cmd.Bind(FUNC_Broadcast, (*Args)(nil))
-	cmd.Bind(FUNC_ServerClose, (*Args)(nil))
-	cmd.Bind(FUNC_HelloGateway, (*Args)(nil))
-	cmd.Bind(FUNC_SwitchServer, (*Args)(nil))
-	cmd.Bind(FUNC_Close, (*Args)(nil))
-	cmd.Bind(FUNC_RegisterServiceInGateway, (*Args)(nil))
-	cmd.Bind(FUNC_SyncServerState, (*Args)(nil))
+	node.Bind(FUNC_Broadcast, (*Args)(nil))
+	node.Bind(FUNC_ServerClose, (*Args)(nil))
+	node.Bind(FUNC_HelloGateway, (*Args)(nil))
+	node.Bind(FUNC_SwitchServer, (*Args)(nil))
+	node.Bind(FUNC_Close, (*Args)(nil))
+	node.Bind(FUNC_RegisterServiceInGateway, (*Args)(nil))
+	node.Bind(FUNC_SyncServerState, (*Args)(nil))
 
-	cmd.Bind(HeartBeat, (*Args)(nil))
+	node.Bind(HeartBeat, (*Args)(nil))
 }
 
 func FUNC_Close(ctx *cmd.Context, data interface{}) {
 	log.Debugf("session close %s", ctx.Ssid)
 	if v, ok := sessionLocations.Load(ctx.Ssid); ok {
 		loc := v.(*sessionLocation)
-		ss := &cmd.Session{Id: ctx.Ssid, Out: ctx.Out}
+		ss := ctx.Node().NewSession(ctx.Ssid, ctx.Out)
 		ss.Route(loc.ServerName, "Close", struct{}{})
 
 	}
@@ -53,7 +66,7 @@ func FUNC_HelloGateway(ctx *cmd.Context, data interface{}) {
 	log.Debugf("session locate ssid:%s server name:%s", ctx.Ssid, args.ServerName)
 
 	ip := "UNKNOW"
-	if ss := cmd.GetSession(ctx.Ssid); ss != nil {
+	if ss := ctx.Node().GetSession(ctx.Ssid); ss != nil {
 		addr := ss.Out.RemoteAddr()
 		loc := &sessionLocation{ServerName: args.ServerName, MatchServer: args.ServerName}
 		sessionLocations.Store(ctx.Ssid, loc)
@@ -69,7 +82,7 @@ func FUNC_SwitchServer(ctx *cmd.Context, data interface{}) {
 	args := data.(*Args)
 	log.Debugf("session ssid:%s switch server name:%s", ctx.Ssid, args.ServerName)
 
-	if ss := cmd.GetSession(ctx.Ssid); ss != nil {
+	if ss := ctx.Node().GetSession(ctx.Ssid); ss != nil {
 		if args.ServerName == "" {
 			sessionLocations.Delete(ctx.Ssid)
 		} else {
@@ -83,23 +96,35 @@ func FUNC_SwitchServer(ctx *cmd.Context, data interface{}) {
 func FUNC_Route(ctx *cmd.Context, data interface{}) {
 	args := data.(*Args)
 	// log.Info("route", ctx.Ssid)
-	if ss := cmd.GetSession(ctx.Ssid); ss != nil {
+	if ss := ctx.Node().GetSession(ctx.Ssid); ss != nil {
 		// client := ctx.Out.(*cmd.Client)
 		// id := fmt.Sprintf("%s.%s", client.ServerName(), args.Id)
 		ss.Out.WriteJSON(args.Id, args.Data)
 	}
 }
 
+// 服务处理客户端消息失败时，转发错误到客户端
+func FUNC_ServerError(ctx *cmd.Context, data interface{}) {
+	args := data.(*errorArgs)
+	if ctx.Ssid == "" {
+		log.Debugf("server error %d %s: %s", args.Code, args.MsgId, args.Err)
+		return
+	}
+	if ss := ctx.Node().GetSession(ctx.Ssid); ss != nil {
+		ss.Out.WriteJSON(cmd.ErrorReplyId, args)
+	}
+}
+
 func FUNC_Broadcast(ctx *cmd.Context, data interface{}) {
 	args := data.(*Args)
-	for _, ss := range cmd.GetSessionList() {
+	for _, ss := range ctx.Node().GetSessionList() {
 		ss.Out.WriteJSON(args.Id, args.Data)
 	}
 }
 
 func FUNC_ServerClose(ctx *cmd.Context, data interface{}) {
 	client := ctx.Out.(*cmd.Client)
-	for _, ss := range cmd.GetSessionList() {
+	for _, ss := range ctx.Node().GetSessionList() {
 		// 2020-11-24 仅通知在当前服务的连接
 		if v, ok := sessionLocations.Load(ss.Id); ok {
 			loc := v.(*sessionLocation)
@@ -112,7 +137,7 @@ func FUNC_ServerClose(ctx *cmd.Context, data interface{}) {
 }
 
 func HeartBeat(ctx *cmd.Context, data interface{}) {
-	ctx.Out.WriteJSON("HeartBeat", struct{}{})
+	ctx.WriteJSON("HeartBeat", struct{}{})
 }
 
 // Deprecated: use FUNC_SyncServerState
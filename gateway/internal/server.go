@@ -6,11 +6,10 @@ package gateway
 
 import (
 	"context"
-	"errors"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -26,6 +25,7 @@ const (
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
 	maxMessageSize = 96 << 10 // 96K
+	readLimit      = 4 << 10  // 客户端消息的最大长度，二进制帧为解压后的长度
 	sendQueueSize  = 16 << 10
 )
 
@@ -36,15 +36,24 @@ var upgrader = websocket.Upgrader{
 }
 
 type WsConn struct {
-	ws      *websocket.Conn
-	ssid    string
-	send    chan []byte
-	isClose bool
-	mu      sync.RWMutex
+	ws   *websocket.Conn
+	ssid string
+	send *cmd.SendQueue
+
+	// 协商压缩后使用二进制帧
+	compressor *cmd.Compressor
+	threshold  int
 }
 
 func init() {
-	http.HandleFunc("/ws", serveWs)
+	http.Handle("/ws", NewHandler(cmd.DefaultNode()))
+}
+
+// 客户端的会话及消息由node处理，node需通过Bind注册网关的消息
+func NewHandler(node *cmd.Node) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(node, w, r)
+	})
 }
 
 func (c *WsConn) RemoteAddr() string {
@@ -52,17 +61,13 @@ func (c *WsConn) RemoteAddr() string {
 }
 
 func (c *WsConn) Close() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if !c.isClose {
-		c.isClose = true
-		close(c.send)
-	}
+	c.send.Close()
 }
 
 func (c *WsConn) WriteJSON(name string, i interface{}) error {
-	// 消息格式
-	pkg := &cmd.Package{Id: name, Body: i, IsZip: true}
+	// 消息格式。二进制帧整体压缩，不再单独压缩数据
+	pkg := &cmd.Package{Id: name, Body: i, IsZip: c.compressor == nil}
+	cmd.RecordSend(&cmd.Package{Id: name, Body: i, Ssid: c.ssid})
 	buf, err := pkg.Encode()
 	if err != nil {
 		return err
@@ -70,15 +75,13 @@ func (c *WsConn) WriteJSON(name string, i interface{}) error {
 	return c.Write(buf)
 }
 
+// 协商压缩后由写协程编码二进制帧，不占用主协程
 func (c *WsConn) Write(data []byte) error {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	if c.isClose {
-		return errors.New("write to closed chan")
+	err := c.send.Push(data)
+	if err == cmd.ErrSendDisconnect {
+		c.ws.Close()
 	}
-
-	c.send <- data
-	return nil
+	return err
 }
 
 func (c *WsConn) writeMessage(mt int, payload []byte) error {
@@ -86,19 +89,34 @@ func (c *WsConn) writeMessage(mt int, payload []byte) error {
 	return c.ws.WriteMessage(mt, payload)
 }
 
-func serveWs(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
+func serveWs(node *cmd.Node, w http.ResponseWriter, r *http.Request) {
+	ver := cmd.NegotiateVersion(requestVersion(r), maxClientVersion)
+	header := http.Header{versionHeader: {strconv.Itoa(ver)}}
+	compressor, threshold := negotiateCompress(r, header)
+	ws, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		log.Errorf("%v", err)
 		return
 	}
+	if ver < minClientVersion {
+		log.Debugf("client %s version %d is too low", ws.RemoteAddr(), ver)
+		rejectVersion(ws, ver)
+		return
+	}
 	ssid := util.GUID()
 	c := &WsConn{
-		ssid: ssid,
-		ws:   ws,
-		send: make(chan []byte, 1<<10),
+		ssid:       ssid,
+		ws:         ws,
+		send:       cmd.NewSendQueue(sendQueueSize, cmd.GetBackpressure("ws")),
+		compressor: compressor,
+		threshold:  threshold,
 	}
-	cmd.AddSession(&cmd.Session{Id: ssid, Out: c})
+	frameType := websocket.TextMessage
+	if compressor != nil {
+		frameType = websocket.BinaryMessage
+	}
+	ss := &cmd.Session{Id: ssid, Out: c, Version: ver}
+	node.AddSession(ss)
 
 	doneCtx, cancel := context.WithCancel(context.Background())
 	go func() {
@@ -106,21 +124,30 @@ func serveWs(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			// c.writeMessage(websocket.CloseMessage, []byte{})
 			c.ws.Close()
-			ticker.Stop() // 关闭定时器
+			c.send.Close() // 写协程退出后不再入队
+			ticker.Stop()  // 关闭定时器
 
-			ctx := &cmd.Context{Ssid: c.ssid, Out: c}
-			cmd.Handle(ctx, "CMD_Close", nil)
-			cmd.Handle(ctx, "FUNC_Close", nil)
-			cmd.RemoveSession(c.ssid)
+			ctx := &cmd.Context{Ssid: c.ssid, Out: c, Version: ver}
+			node.Handle(ctx, "CMD_Close", nil)
+			node.Handle(ctx, "FUNC_Close", nil)
+			node.RemoveSession(c.ssid)
 		}()
 
 		for {
 			select {
-			case buf, ok := <-c.send:
+			case buf, ok := <-c.send.C():
 				if !ok {
 					return
 				}
-				if err := c.writeMessage(websocket.TextMessage, buf); err != nil {
+				if compressor != nil {
+					frame, err := cmd.EncodeFrame(compressor, threshold, buf)
+					if err != nil {
+						log.Debug("encode frame", err)
+						continue
+					}
+					buf = frame
+				}
+				if err := c.writeMessage(frameType, buf); err != nil {
 					log.Debug("write message", err)
 					return
 				}
@@ -134,7 +161,7 @@ func serveWs(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	c.ws.SetReadLimit(4 << 10)
+	c.ws.SetReadLimit(readLimit)
 	c.ws.SetReadDeadline(time.Now().Add(pongWait))
 	c.ws.SetPongHandler(func(string) error {
 		c.ws.SetReadDeadline(time.Now().Add(pongWait))
@@ -148,20 +175,31 @@ func serveWs(w http.ResponseWriter, r *http.Request) {
 
 	remoteAddr := c.ws.RemoteAddr().String()
 	matchMsg, _ := regexp.Compile("^[A-Za-z0-9]+$")
+	nonces := cmd.NewNonceWindow()
 	for {
-		_, message, err := c.ws.ReadMessage()
+		mt, message, err := c.ws.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
 				log.Debugf("websocket close, %v", err)
 			}
 			return
 		}
+		if mt == websocket.BinaryMessage {
+			if message, err = cmd.DecodeFrame(message, readLimit); err != nil {
+				log.Warnf("client %s %v", remoteAddr, err)
+				return
+			}
+		}
 
 		pkg, err := cmd.Decode(message)
 		if err != nil {
 			log.Warn(err)
 			return
 		}
+		if err := nonces.Check(pkg); err != nil {
+			log.Warnf("client %s %v", remoteAddr, err)
+			return
+		}
 
 		// 网络限流
 		recvPackageCounter++
@@ -216,8 +254,11 @@ func serveWs(w http.ResponseWriter, r *http.Request) {
 			ClientAddr:  c.RemoteAddr(),
 			MatchServer: matchServer,
 			ServerName:  serverName,
+			Version:     ver,
 		}
-		if err := cmd.Handle(ctx, pkg.Id, pkg.Data); err != nil {
+		ctx.StartTrace()
+		ss.SetTrace(ctx)
+		if err := node.Handle(ctx, pkg.Id, pkg.Data); err != nil {
 			log.Warnf("handle client %s %v", remoteAddr, err)
 		}
 	}
@@ -0,0 +1,56 @@
+package gateway
+
+// 2021-10-08 握手时协商协议版本
+// 客户端通过URL参数ver或请求头X-Protocol-Version上报支持的最高版本
+// 协商的版本通过响应头X-Protocol-Version返回，低于最低版本时拒绝连接
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/guogeer/quasar/cmd"
+	"github.com/guogeer/quasar/config"
+)
+
+const versionHeader = "X-Protocol-Version"
+
+var minClientVersion, maxClientVersion int
+
+func init() {
+	cfg := config.Config().Gateway
+	SetClientVersion(cfg.MinVersion, cfg.MaxVersion)
+}
+
+// 设置客户端的最低及最高协议版本，maxVersion为0时不限
+func SetClientVersion(minVersion, maxVersion int) {
+	minClientVersion, maxClientVersion = minVersion, maxVersion
+}
+
+// 客户端上报的版本，未上报时为0
+func requestVersion(r *http.Request) int {
+	s := r.URL.Query().Get("ver")
+	if s == "" {
+		s = r.Header.Get(versionHeader)
+	}
+	ver, _ := strconv.Atoi(s)
+	return ver
+}
+
+// 回复版本过低后关闭连接
+func rejectVersion(ws *websocket.Conn, ver int) {
+	msg := fmt.Sprintf("version %d is lower than %d", ver, minClientVersion)
+	pkg := &cmd.Package{
+		Id:   cmd.ErrorReplyId,
+		Body: map[string]interface{}{"Code": cmd.CodeVersionTooLow, "Err": msg},
+		Code: cmd.CodeVersionTooLow,
+		Err:  msg,
+	}
+	if buf, err := pkg.Encode(); err == nil {
+		ws.SetWriteDeadline(time.Now().Add(writeWait))
+		ws.WriteMessage(websocket.TextMessage, buf)
+	}
+	ws.Close()
+}
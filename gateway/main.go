@@ -1,19 +1,27 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
 	"github.com/guogeer/quasar/cmd"
-	_ "github.com/guogeer/quasar/gateway/internal"
+	gateway "github.com/guogeer/quasar/gateway/internal"
 	"github.com/guogeer/quasar/log"
 	"github.com/guogeer/quasar/util"
-	"net/http"
-	"runtime"
 )
 
 var port = flag.Int("port", 8201, "gateway server port")
 var proxy = flag.String("proxy", "", "gateway server proxy addr")
 
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	flag.Parse()
 
@@ -26,13 +34,29 @@ func main() {
 	}
 	cmd.RegisterService(cfg)
 
-	addr = fmt.Sprintf(":%d", *port)
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", *port)}
 	go func() {
-		if err := http.ListenAndServe(addr, nil); err != nil {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
 	}()
 
+	// 收到SIGTERM后先注销服务，再断开客户端
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+
+		log.Info("gateway shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := gateway.Shutdown(ctx, srv, cfg.ServerName); err != nil {
+			log.Errorf("shutdown %v", err)
+		}
+		close(done)
+	}()
+
 	defer func() {
 		if err := recover(); err != nil {
 			const size = 64 << 10
@@ -43,9 +67,16 @@ func main() {
 		}
 	}()
 
-	for {
+	for isRunning := true; isRunning; {
+		select {
+		case <-done:
+			isRunning = false // 处理剩余的关闭消息后退出
+		default:
+		}
 		util.GetTimerSet().RunOnce()
 		// handle message
 		cmd.RunOnce()
 	}
+	// 超过单次处理上限的关闭消息
+	cmd.Drain()
 }
@@ -1,10 +1,11 @@
 module github.com/guogeer/quasar
 
-go 1.15
+go 1.18
 
 require (
 	github.com/buger/jsonparser v0.0.0-20191204142016-1a29609e0929
 	github.com/go-yaml/yaml v2.1.0+incompatible
+	github.com/golang/snappy v1.0.0
 	github.com/google/uuid v1.1.1
 	github.com/gorilla/websocket v1.4.1
 	github.com/yuin/gopher-lua v0.0.0-20191128022950-c6266f4fe8d7
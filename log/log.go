@@ -101,6 +101,11 @@ func (l *FileLog) cleanFilesLocked(path string) {
 }
 
 func (l *FileLog) Output(level, s string) {
+	l.output(3, level, s)
+}
+
+// skip为runtime.Caller的参数
+func (l *FileLog) output(skip int, level, s string) {
 	// 比较等级
 	l.mu.Lock()
 	for i := range logLevels {
@@ -113,7 +118,7 @@ func (l *FileLog) Output(level, s string) {
 		}
 	}
 
-	_, codePath, codeLine, ok := runtime.Caller(2)
+	_, codePath, codeLine, ok := runtime.Caller(skip)
 	if !ok {
 		codePath = "???"
 	}
@@ -238,6 +243,11 @@ func Fatal(v ...interface{}) {
 	os.Exit(0)
 }
 
+// calldepth为1时输出调用Output的代码位置，同标准库log.Output
+func Output(calldepth int, level, s string) {
+	fileLog.output(calldepth+1, level, s)
+}
+
 func Printf(level, format string, v ...interface{}) {
 	level = strings.ToUpper(level)
 	fileLog.Output(level, fmt.Sprintf(format, v...))
@@ -0,0 +1,79 @@
+package main
+
+// 回放录制的消息
+// 指定local时离线回放到当前进程的节点并输出回复，需导入注册消息的包，如import _ "game/hall"
+// 指定addr时发送到运行中的服务，否则输出录制的消息
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/guogeer/quasar/cmd"
+	"github.com/guogeer/quasar/log"
+)
+
+var (
+	file  = flag.String("file", "record.log", "record file")
+	addr  = flag.String("addr", "", "replay to server addr, print records if empty")
+	local = flag.Bool("local", false, "replay to handlers registered in this process offline")
+	speed = flag.Float64("speed", 1, "replay speed, no wait if not positive")
+	ssid  = flag.String("ssid", "", "only replay messages of the session")
+	msgId = flag.String("id", "", "only replay the message id")
+)
+
+func main() {
+	flag.Parse()
+
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	filter := func(rec *cmd.Record) bool {
+		return (*ssid == "" || rec.Ssid == *ssid) && (*msgId == "" || rec.Id == *msgId)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancel()
+	opts := cmd.ReplayOptions{Speed: *speed, Filter: filter}
+	if *local {
+		if err := replayLocal(ctx, cmd.DefaultNode(), f, opts, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *addr == "" {
+		err = cmd.ReadRecords(f, func(rec *cmd.Record) error {
+			if filter(rec) {
+				fmt.Printf("%s %-3s %s %s %s\n", rec.Time.Format("2006-01-02 15:04:05.000"), rec.Dir, rec.Ssid, rec.Id, rec.Data)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := cmd.ReplayTo(ctx, *addr, f, opts); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("replay %s to %s done", *file, *addr)
+}
+
+// 回放到节点，输出处理函数的回复
+func replayLocal(ctx context.Context, node *cmd.Node, r io.Reader, opts cmd.ReplayOptions, w io.Writer) error {
+	out := cmd.NewRecordConn()
+	if err := node.Replay(ctx, r, opts, out); err != nil {
+		return err
+	}
+	for _, pkg := range out.Packages() {
+		fmt.Fprintf(w, "%s %s %s\n", pkg.Ssid, pkg.Id, pkg.Data)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/guogeer/quasar/cmd"
+)
+
+type testArgs struct {
+	N int
+}
+
+func TestReplayLocal(t *testing.T) {
+	var records bytes.Buffer
+	for i, id := range []string{"TestReplay", "FUNC_Close", "TestReplay"} {
+		data, _ := json.Marshal(testArgs{N: i + 1})
+		rec := &cmd.Record{Time: time.Now(), Dir: cmd.RecordIn, Package: cmd.Package{Id: id, Ssid: "abc", Data: data}}
+		buf, _ := json.Marshal(rec)
+		records.Write(append(buf, '\n'))
+	}
+
+	node := cmd.NewNode()
+	var closed bool
+	cmd.NodeOn(node, "TestReplay", func(ctx *cmd.Context, args *testArgs) {
+		args.N++
+		ctx.Out.WriteJSON("TestReplayOk", args)
+	})
+	cmd.NodeOn(node, "FUNC_Close", func(ctx *cmd.Context, args *testArgs) { closed = true })
+
+	var out bytes.Buffer
+	if err := replayLocal(context.Background(), node, &records, cmd.ReplayOptions{}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if closed {
+		t.Error("replay internal message")
+	}
+	if s := out.String(); s != " TestReplayOk {\"N\":2}\n TestReplayOk {\"N\":4}\n" {
+		t.Errorf("replay replies %q", s)
+	}
+}
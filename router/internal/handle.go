@@ -3,6 +3,7 @@ package router
 import (
 	"encoding/json"
 	"net"
+	"strings"
 
 	"github.com/guogeer/quasar/cmd"
 	"github.com/guogeer/quasar/log"
@@ -16,55 +17,71 @@ type Args struct {
 }
 
 func init() {
-	cmd.Bind(C2S_Register, (*Args)(nil))
-	cmd.Bind(C2S_GetServerAddr, (*Args)(nil))
-	cmd.Bind(C2S_Concurrent, (*Args)(nil))
-	cmd.Bind(C2S_Route, (*cmd.ForwardArgs)(nil))
+	Bind(cmd.DefaultNode())
+}
+
+// 注册路由的消息。测试时可在单独的节点上启动路由，服务表为全局变量，同一进程仅支持一个路由
+func Bind(node *cmd.Node) {
+	node.Bind(C2S_Register, (*Args)(nil))
+	node.Bind(C2S_Unregister, (*Args)(nil))
+	node.Bind(C2S_GetServerAddr, (*Args)(nil))
+	node.Bind(C2S_Concurrent, (*Args)(nil))
+	node.Bind(C2S_Route, (*cmd.ForwardArgs)(nil))
 
-	cmd.Bind(C2S_Broadcast, (*cmd.Package)(nil))
-	cmd.Bind(FUNC_Close, (*Args)(nil))
+	node.Bind(C2S_Broadcast, (*cmd.Package)(nil))
+	node.Bind(FUNC_Close, (*Args)(nil))
+
+	node.Bind(C2S_Subscribe, (*cmd.SubscribeArgs)(nil))
+	node.Bind(C2S_Unsubscribe, (*cmd.SubscribeArgs)(nil))
+	node.Bind(C2S_Publish, (*cmd.PublishArgs)(nil))
 }
 
 // ServerAddr == "" 无服务
 func C2S_Register(ctx *cmd.Context, data interface{}) {
 	args := data.(*Args)
-	host, port, _ := net.SplitHostPort(args.ServerAddr)
-	if host == "" {
-		host, _, _ = net.SplitHostPort(ctx.Out.RemoteAddr())
-	}
-
-	addr := ""
-	if port != "" {
-		addr = host + ":" + port
+	connHost := remoteHost(ctx.Out)
+	// 多个地址以逗号分隔。unix socket及进程内的地址原样保存
+	var addrs []string
+	for _, s := range strings.Split(args.ServerAddr, ",") {
+		if s = strings.TrimSpace(s); strings.Contains(s, "://") {
+			addrs = append(addrs, s)
+			continue
+		}
+		host, port, _ := net.SplitHostPort(s)
+		if host == "" {
+			host = connHost
+		}
+		// 经unix socket注册时无法获取主机地址，其他主机无法连接不含主机的TCP地址
+		if host == "" && port != "" {
+			log.Warnf("server %s register by unix socket, ignore tcp addr %s without host", args.ServerName, s)
+			continue
+		}
+		if port != "" {
+			addrs = append(addrs, net.JoinHostPort(host, port))
+		}
 	}
+	addr := strings.Join(addrs, ",")
 	log.Infof("register server:%s %v addr:%s", args.ServerName, args.ServerList, addr)
-	ctx.Out.WriteJSON("C2S_RegisterOk", struct{}{})
+	ctx.WriteJSON("C2S_RegisterOk", struct{}{})
 
 	newServer := &Server{
 		out:        ctx.Out,
 		name:       args.ServerName,
 		addr:       addr,
+		host:       connHost,
 		data:       args.ServerData,
 		typ:        args.ServerType,
 		serverList: args.ServerList,
 	}
 	addServer(newServer)
-	// center server
-	if newServer.typ == serverCenter {
-		for _, server := range servers {
-			ctx.Out.WriteJSON("S2C_AddGame", map[string]interface{}{
-				"Name": server.name,
-				"Data": server.data,
-			})
-		}
+	// 通知订阅服务注册的连接
+	if buf, err := json.Marshal(serverAddArgs(newServer)); err == nil {
+		publish(ctx, cmd.TopicServerAdd, "S2C_AddGame", buf, ctx.Out)
 	}
-	for _, server := range servers {
-		if server.typ == serverCenter && server.name != newServer.name {
-			server.out.WriteJSON("S2C_AddGame", map[string]interface{}{
-				"Name": newServer.name,
-				"Data": newServer.data,
-			})
-		}
+	// Deprecated: 世界服使用cmd.Subscribe(cmd.TopicServerAdd)
+	// 兼容未订阅的旧版世界服，注册后自动订阅，仍可收到S2C_AddGame
+	if newServer.typ == serverCenter {
+		subscribe(ctx.Out, cmd.TopicServerAdd)
 	}
 
 	// Deprecated: use FUNC_SyncServerState
@@ -86,13 +103,24 @@ func C2S_Register(ctx *cmd.Context, data interface{}) {
 	}
 }
 
+// 服务关闭前主动注销
+func C2S_Unregister(ctx *cmd.Context, data interface{}) {
+	if server := unregisterServer(ctx.Out); server != nil {
+		log.Infof("unregister server %s", server.name)
+	}
+	ctx.WriteJSON("C2S_UnregisterOk", struct{}{})
+}
+
 func C2S_GetServerAddr(ctx *cmd.Context, data interface{}) {
 	args := data.(*Args)
 	name := args.ServerName
-	addr := matchBestServer(name)
+	var addr string
+	if server := matchBestServer(name); server != nil {
+		addr = server.addrFor(remoteHost(ctx.Out))
+	}
 	log.Infof("get server:%s addr:%s", name, addr)
 	response := map[string]string{"ServerName": name, "ServerAddr": addr}
-	ctx.Out.WriteJSON("S2C_GetServerAddr", response)
+	ctx.WriteJSON("S2C_GetServerAddr", response)
 }
 
 func C2S_Broadcast(ctx *cmd.Context, data interface{}) {
@@ -134,24 +162,15 @@ func C2S_Route(ctx *cmd.Context, data interface{}) {
 
 	for _, name := range serverList {
 		if s := getServer(name); s != nil {
-			s.out.WriteJSON(args.Name, args.Data)
+			ctx.WriteTo(s.out, args.Name, args.Data)
 		}
 	}
 }
 
 func FUNC_Close(ctx *cmd.Context, data interface{}) {
 	// args := data.(*Args)
-	server := findServerByConn(ctx.Out)
-	if server == nil {
-		return
-	}
-	log.Infof("server %s lose connection", server.name)
-
-	removeServer(ctx.Out)
-	switch server.typ {
-	case serverGateway:
-		syncBestGateway()
-	default:
-		syncServerState()
+	removeSubscriptions(ctx.Out)
+	if server := unregisterServer(ctx.Out); server != nil {
+		log.Infof("server %s lose connection", server.name)
 	}
 }
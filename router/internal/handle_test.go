@@ -0,0 +1,42 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/guogeer/quasar/cmd"
+)
+
+// 无主机地址的连接，如unix socket
+func TestRegisterByUnix(t *testing.T) {
+	out := cmd.NewRecordConn()
+	args := &Args{}
+	args.ServerName = "test_unix"
+	args.ServerAddr = "unix:///tmp/test_unix.sock,:9010,10.0.0.1:9011"
+	C2S_Register(&cmd.Context{Out: out}, args)
+	defer delete(servers, "test_unix")
+
+	server := servers["test_unix"]
+	if server == nil {
+		t.Fatal("register server")
+	}
+	if server.addr != "unix:///tmp/test_unix.sock,10.0.0.1:9011" {
+		t.Error("register addr", server.addr)
+	}
+	if addr := server.addrFor("10.0.0.2"); addr != "10.0.0.1:9011" {
+		t.Error("addr for other host", addr)
+	}
+}
+
+// 同步请求的回复携带ReqId
+func TestRegisterReply(t *testing.T) {
+	out := cmd.NewRecordConn()
+	args := &Args{}
+	args.ServerName = "test_reply"
+	C2S_Register(&cmd.Context{Out: out, ReqId: 7}, args)
+	defer delete(servers, "test_reply")
+
+	pkgs := out.Packages()
+	if len(pkgs) == 0 || pkgs[0].Id != "C2S_RegisterOk" || pkgs[0].ReqId != 7 {
+		t.Error("register reply", pkgs)
+	}
+}
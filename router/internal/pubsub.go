@@ -0,0 +1,90 @@
+package router
+
+// 2021-10-16 主题订阅表，连接关闭时清理
+
+import (
+	"encoding/json"
+
+	"github.com/guogeer/quasar/cmd"
+	"github.com/guogeer/quasar/log"
+)
+
+// 订阅的主题->连接
+var subscriptions = map[string]map[cmd.Conn]bool{}
+
+func C2S_Subscribe(ctx *cmd.Context, data interface{}) {
+	args := data.(*cmd.SubscribeArgs)
+	for _, topic := range args.Topics {
+		subscribe(ctx.Out, topic)
+	}
+}
+
+func C2S_Unsubscribe(ctx *cmd.Context, data interface{}) {
+	args := data.(*cmd.SubscribeArgs)
+	for _, topic := range args.Topics {
+		if conns := subscriptions[topic]; conns != nil {
+			delete(conns, ctx.Out)
+			if len(conns) == 0 {
+				delete(subscriptions, topic)
+			}
+		}
+	}
+}
+
+func C2S_Publish(ctx *cmd.Context, data interface{}) {
+	args := data.(*cmd.PublishArgs)
+	publish(ctx, args.Topic, args.Name, args.Data, nil)
+}
+
+// 重复订阅时忽略
+func subscribe(out cmd.Conn, topic string) {
+	conns := subscriptions[topic]
+	if conns == nil {
+		conns = map[cmd.Conn]bool{}
+		subscriptions[topic] = conns
+	}
+	if conns[out] {
+		return
+	}
+	conns[out] = true
+	log.Debugf("%s subscribe %s", out.RemoteAddr(), topic)
+
+	// 返回已注册的服务
+	if cmd.MatchTopic(topic, cmd.TopicServerAdd) {
+		for _, server := range servers {
+			out.WriteJSON("S2C_AddGame", serverAddArgs(server))
+		}
+	}
+}
+
+// 发布到匹配的连接，每个连接仅发送一次
+func publish(ctx *cmd.Context, topic, name string, data json.RawMessage, except cmd.Conn) {
+	sent := map[cmd.Conn]bool{}
+	for pattern, conns := range subscriptions {
+		if !cmd.MatchTopic(pattern, topic) {
+			continue
+		}
+		for out := range conns {
+			if out != except && !sent[out] {
+				sent[out] = true
+				ctx.WriteTo(out, name, data)
+			}
+		}
+	}
+}
+
+func removeSubscriptions(out cmd.Conn) {
+	for topic, conns := range subscriptions {
+		delete(conns, out)
+		if len(conns) == 0 {
+			delete(subscriptions, topic)
+		}
+	}
+}
+
+func serverAddArgs(server *Server) map[string]interface{} {
+	return map[string]interface{}{
+		"Name": server.name,
+		"Data": server.data,
+	}
+}
@@ -0,0 +1,127 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/guogeer/quasar/cmd"
+)
+
+func resetSubscriptions() {
+	subscriptions = map[string]map[cmd.Conn]bool{}
+}
+
+func countPackages(out *cmd.RecordConn, id string) int {
+	var n int
+	for _, pkg := range out.Packages() {
+		if pkg.Id == id {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPublishWildcard(t *testing.T) {
+	defer resetSubscriptions()
+	c1, c2, c3 := cmd.NewRecordConn(), cmd.NewRecordConn(), cmd.NewRecordConn()
+	C2S_Subscribe(&cmd.Context{Out: c1}, &cmd.SubscribeArgs{Topics: []string{"game.*.start"}})
+	// 多个主题匹配同一消息时仅发送一次
+	C2S_Subscribe(&cmd.Context{Out: c2}, &cmd.SubscribeArgs{Topics: []string{"game.#", "game.texas.start", "game.texas.start"}})
+	C2S_Subscribe(&cmd.Context{Out: c3}, &cmd.SubscribeArgs{Topics: []string{"hall.#"}})
+	if len(subscriptions["game.texas.start"]) != 1 {
+		t.Error("duplicate subscription", subscriptions)
+	}
+
+	data := json.RawMessage(`{"N":1}`)
+	C2S_Publish(&cmd.Context{Out: c3}, &cmd.PublishArgs{Topic: "game.texas.start", Name: "TestStart", Data: data})
+	C2S_Publish(&cmd.Context{Out: c3}, &cmd.PublishArgs{Topic: "game.texas.end", Name: "TestEnd", Data: data})
+	if n := countPackages(c1, "TestStart"); n != 1 || countPackages(c1, "TestEnd") != 0 {
+		t.Error("publish to game.*.start", c1.Packages())
+	}
+	if countPackages(c2, "TestStart") != 1 || countPackages(c2, "TestEnd") != 1 {
+		t.Error("publish to game.#", c2.Packages())
+	}
+	if len(c3.Packages()) != 0 {
+		t.Error("publish to unmatched", c3.Packages())
+	}
+
+	C2S_Unsubscribe(&cmd.Context{Out: c1}, &cmd.SubscribeArgs{Topics: []string{"game.*.start"}})
+	if _, ok := subscriptions["game.*.start"]; ok {
+		t.Error("unsubscribe", subscriptions)
+	}
+}
+
+func TestRemoveSubscriptionsOnClose(t *testing.T) {
+	defer resetSubscriptions()
+	c1, c2 := cmd.NewRecordConn(), cmd.NewRecordConn()
+	C2S_Subscribe(&cmd.Context{Out: c1}, &cmd.SubscribeArgs{Topics: []string{"game.#", "hall.login"}})
+	C2S_Subscribe(&cmd.Context{Out: c2}, &cmd.SubscribeArgs{Topics: []string{"game.#"}})
+
+	FUNC_Close(&cmd.Context{Out: c1}, &Args{})
+	if len(subscriptions) != 1 || len(subscriptions["game.#"]) != 1 || !subscriptions["game.#"][c2] {
+		t.Error("remove subscriptions", subscriptions)
+	}
+}
+
+func TestServerAddTopic(t *testing.T) {
+	defer resetSubscriptions()
+	defer func() { servers = map[string]*Server{} }()
+
+	// 订阅后返回已注册的服务
+	hall := &Args{}
+	hall.ServerName = "test_hall"
+	C2S_Register(&cmd.Context{Out: cmd.NewRecordConn()}, hall)
+	sub := cmd.NewRecordConn()
+	C2S_Subscribe(&cmd.Context{Out: sub}, &cmd.SubscribeArgs{Topics: []string{"router.server.*"}})
+	if countPackages(sub, "S2C_AddGame") != 1 {
+		t.Error("subscribe server add", sub.Packages())
+	}
+
+	// 旧版世界服未订阅，注册后仍收到S2C_AddGame
+	center := &Args{}
+	center.ServerName, center.ServerType = "test_center", serverCenter
+	centerOut := cmd.NewRecordConn()
+	C2S_Register(&cmd.Context{Out: centerOut}, center)
+	// 与原有逻辑一致，包括世界服自己
+	if countPackages(centerOut, "S2C_AddGame") != 2 {
+		t.Error("legacy center registered servers", centerOut.Packages())
+	}
+
+	game := &Args{}
+	game.ServerName = "test_game"
+	C2S_Register(&cmd.Context{Out: cmd.NewRecordConn()}, game)
+	if countPackages(centerOut, "S2C_AddGame") != 3 || countPackages(sub, "S2C_AddGame") != 3 {
+		t.Error("publish server add", centerOut.Packages(), sub.Packages())
+	}
+}
+
+// 服务经路由订阅及发布
+func TestRouterPubSub(t *testing.T) {
+	startTestRouter(t, "mem://test_pubsub_router")
+
+	recv := make(chan int, 4)
+	sub, pub := cmd.NewNode(), cmd.NewNode()
+	cmd.NodeOnWithoutQueue(sub, "TestTopic", func(ctx *cmd.Context, args *testArgs) { recv <- args.N })
+	for _, node := range []*cmd.Node{sub, pub} {
+		node.SetRouterAddr("mem://test_pubsub_router")
+	}
+	if err := sub.Subscribe("game.#"); err != nil {
+		t.Fatal(err)
+	}
+	// 同一连接的消息按顺序处理，收到回复时订阅已生效
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	sub.Call(ctx, "router", "C2S_GetServerAddr", &Args{}, &Args{})
+
+	pub.Publish("game.texas.start", "TestTopic", &testArgs{N: 5})
+	select {
+	case n := <-recv:
+		if n != 5 {
+			t.Error("recv topic message", n)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("wait topic message timeout")
+	}
+}
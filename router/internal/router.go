@@ -2,6 +2,8 @@ package router
 
 import (
 	"encoding/json"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/guogeer/quasar/cmd"
@@ -23,7 +25,8 @@ type Server struct {
 
 	name       string
 	typ        string
-	addr       string   // 地址
+	addr       string   // 地址，多个地址以逗号分隔
+	host       string   // 注册连接的主机，unix socket连接时为空
 	serverList []string // 子服务
 
 	minWeight int // 最大负载
@@ -52,18 +55,49 @@ func getBestGateway() string {
 }
 
 // 匹配服务
-func matchBestServer(name string) string {
+func matchBestServer(name string) *Server {
 	if server, ok := servers[name]; ok {
-		return server.addr
+		return server
 	}
 	for _, server := range servers {
 		for _, serverName := range server.serverList {
 			if serverName == name {
-				return server.addr
+				return server
 			}
 		}
 	}
-	return ""
+	return nil
+}
+
+// 连接的主机，unix socket或进程内的连接为空
+func remoteHost(out cmd.Conn) string {
+	host, _, _ := net.SplitHostPort(out.RemoteAddr())
+	return host
+}
+
+func isLocalHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func isSameHost(host1, host2 string) bool {
+	return host1 == host2 || (isLocalHost(host1) && isLocalHost(host2))
+}
+
+// unix socket地址仅返回给同一主机的请求方，其他主机使用TCP地址
+func (server *Server) addrFor(host string) string {
+	sameHost := isSameHost(server.host, host)
+	var addrs []string
+	for _, addr := range strings.Split(server.addr, ",") {
+		if addr == "" || (strings.HasPrefix(addr, "unix://") && !sameHost) {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return strings.Join(addrs, ",")
 }
 
 func getServer(name string) *Server {
@@ -89,6 +123,21 @@ func removeServer(out cmd.Conn) *Server {
 	return nil
 }
 
+// 移除服务并同步
+func unregisterServer(out cmd.Conn) *Server {
+	server := removeServer(out)
+	if server == nil {
+		return nil
+	}
+	switch server.typ {
+	case serverGateway:
+		syncBestGateway()
+	default:
+		syncServerState()
+	}
+	return server
+}
+
 // 查找链接的服务
 func findServerByConn(out cmd.Conn) *Server {
 	for _, server := range gateways {
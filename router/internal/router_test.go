@@ -0,0 +1,95 @@
+package router
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/guogeer/quasar/cmd"
+	"github.com/guogeer/quasar/log"
+)
+
+type testArgs struct {
+	N int
+}
+
+func TestMain(m *testing.M) {
+	log.SetLevel("FATAL")
+	m.Run()
+}
+
+// 进程内启动路由，测试结束后停止处理消息并清理服务表
+func startTestRouter(t *testing.T, addr string) {
+	node := cmd.NewNode()
+	Bind(node)
+	srv := &cmd.Server{Addr: addr, Node: node}
+	go srv.ListenAndServe()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			node.RunOnce()
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		wg.Wait()
+		srv.Shutdown(context.Background())
+		servers = map[string]*Server{}
+		gateways = map[string]*Server{}
+		subscriptions = map[string]map[cmd.Conn]bool{}
+	})
+}
+
+// 等待服务注册到路由
+func waitServer(t *testing.T, node *cmd.Node, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	for {
+		resp := &Args{}
+		req := &Args{}
+		req.ServerName = name
+		if err := node.Call(ctx, "router", "C2S_GetServerAddr", req, resp); err != nil {
+			t.Fatal("wait server", name, err)
+		}
+		if resp.ServerAddr != "" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRouterCluster(t *testing.T) {
+	startTestRouter(t, "mem://test_router")
+
+	hall := cmd.NewNode()
+	hallSrv := &cmd.Server{Addr: "mem://test_router_hall", Node: hall}
+	go hallSrv.ListenAndServe()
+	defer hallSrv.Shutdown(context.Background())
+	cmd.NodeOnWithoutQueue(hall, "TestEcho", func(ctx *cmd.Context, args *testArgs) {
+		ctx.WriteJSON("TestEcho", args)
+	})
+	hall.SetRouterAddr("mem://test_router")
+	hall.RegisterService(&cmd.ServiceConfig{ServerName: "hall", ServerAddr: "mem://test_router_hall"})
+
+	client := cmd.NewNode()
+	client.SetRouterAddr("mem://test_router")
+	waitServer(t, client, "hall")
+
+	// 经路由查找服务地址后直连
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	out := &testArgs{}
+	if err := client.Call(ctx, "hall", "TestEcho", &testArgs{N: 3}, out); err != nil || out.N != 3 {
+		t.Error("call hall by router", out, err)
+	}
+}
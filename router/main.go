@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
+	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/guogeer/quasar/cmd"
 	"github.com/guogeer/quasar/config"
@@ -16,16 +22,40 @@ import (
 
 var port = flag.Int("port", 9003, "router server port")
 
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	flag.Parse()
 
-	addr := config.Config().Server("router").Addr
-	_, portStr, _ := net.SplitHostPort(addr)
-	if portStr != "" {
-		*port, _ = strconv.Atoi(portStr)
+	// 同一主机的服务可通过unix socket连接
+	var addrs []string
+	for _, addr := range strings.Split(config.Config().Server("router").Addr, ",") {
+		if strings.HasPrefix(addr, "unix://") {
+			addrs = append(addrs, addr)
+		} else if _, portStr, _ := net.SplitHostPort(addr); portStr != "" {
+			*port, _ = strconv.Atoi(portStr)
+		}
 	}
-	log.Infof("start router server, listen %d", *port)
-	go func() { cmd.ListenAndServe(fmt.Sprintf(":%d", *port)) }()
+	addrs = append(addrs, fmt.Sprintf(":%d", *port))
+	log.Infof("start router server, listen %v", addrs)
+	srv := &cmd.Server{Addr: strings.Join(addrs, ",")}
+	go func() { srv.ListenAndServe() }()
+
+	// 收到SIGTERM后发送完剩余消息再断开连接
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+
+		log.Info("router shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Errorf("shutdown %v", err)
+		}
+		close(done)
+	}()
 
 	defer func() {
 		if err := recover(); err != nil {
@@ -37,9 +67,16 @@ func main() {
 		}
 	}()
 
-	for {
+	for isRunning := true; isRunning; {
+		select {
+		case <-done:
+			isRunning = false // 处理剩余的关闭消息后退出
+		default:
+		}
 		util.GetTimerSet().RunOnce()
 		// handle message
 		cmd.RunOnce()
 	}
+	// 超过单次处理上限的关闭消息
+	cmd.Drain()
 }